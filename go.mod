@@ -1,4 +1,10 @@
 module k8s-log
 
 require github.com/gogf/gf latest
-require github.com/gogf/gkafka latest
\ No newline at end of file
+require github.com/gogf/gkafka latest
+require github.com/Shopify/sarama latest
+require github.com/xdg/scram latest
+require golang.org/x/text latest
+require github.com/prometheus/client_golang latest
+require github.com/klauspost/compress latest
+require go.etcd.io/bbolt latest
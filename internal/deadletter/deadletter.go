@@ -0,0 +1,14 @@
+// 死信记录，log-dumper写入、log-deadletter读取及重新发送共用的结构.
+
+package deadletter
+
+// 死信记录，保存无法解析或者分包不完整的kafka消息，按照JSON行格式写入死信目录或者DEAD_LETTER_TOPIC
+type DeadLetter struct {
+    Time      string   `json:"time"`          // 记录时间
+    Reason    string   `json:"reason"`        // 原因
+    Topic     string   `json:"topic"`         // kafka topic
+    Partition int      `json:"partition"`     // kafka partition
+    Offset    int      `json:"offset"`        // kafka offset(分包消息为最后处理的分包的offset)
+    Key       []byte   `json:"key,omitempty"` // kafka消息key
+    Packages  [][]byte `json:"packages"`      // 原始消息内容，分包消息按照分包序号排列(只包含已到达的分包)
+}
@@ -0,0 +1,157 @@
+// kafka客户端的TLS加密及SASL认证设置，log-agent、log-dumper及log-deadletter共用.
+// 配置通过以下环境变量读取：
+// KAFKA_TLS、KAFKA_TLS_CA_FILE、KAFKA_TLS_CERT_FILE、KAFKA_TLS_KEY_FILE、KAFKA_TLS_SERVER_NAME、KAFKA_TLS_INSECURE、
+// KAFKA_SASL_MECHANISM、KAFKA_SASL_USER(_FILE)、KAFKA_SASL_PASSWORD(_FILE)。
+
+package kafkaauth
+
+import (
+    "crypto/sha512"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "github.com/Shopify/sarama"
+    "github.com/xdg/scram"
+    "hash"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// kafka安全设置
+type Options struct {
+    Tls        bool   // 是否启用TLS
+    CaFile     string // CA证书文件路径，为空时使用系统证书
+    CertFile   string // 客户端证书文件路径(双向认证时使用)
+    KeyFile    string // 客户端私钥文件路径(双向认证时使用)
+    ServerName string // 校验服务端证书时使用的域名，为空时使用连接地址
+    Insecure   bool   // 是否跳过服务端证书校验
+    Sasl       string // SASL认证方式：PLAIN、SCRAM-SHA-256、SCRAM-SHA-512，为空时不启用
+    User       string // SASL用户名
+    Password   string // SASL密码
+}
+
+var (
+    // SCRAM-SHA-512认证使用的哈希函数
+    scramSHA512 scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+)
+
+// SASL/SCRAM认证客户端，实现sarama.SCRAMClient接口
+type scramClient struct {
+    *scram.Client
+    *scram.ClientConversation
+    scram.HashGeneratorFcn
+}
+
+// 开始SCRAM认证会话
+func (c *scramClient) Begin(user, password, authzID string) (err error) {
+    if c.Client, err = c.HashGeneratorFcn.NewClient(user, password, authzID); err != nil {
+        return err
+    }
+    c.ClientConversation = c.Client.NewConversation()
+    return nil
+}
+
+// 处理服务端的认证挑战
+func (c *scramClient) Step(challenge string) (string, error) {
+    return c.ClientConversation.Step(challenge)
+}
+
+// 认证会话是否完成
+func (c *scramClient) Done() bool {
+    return c.ClientConversation.Done()
+}
+
+// 从环境变量读取kafka安全设置
+func FromEnv() *Options {
+    return &Options {
+        Tls        : getBool("KAFKA_TLS"),
+        CaFile     : os.Getenv("KAFKA_TLS_CA_FILE"),
+        CertFile   : os.Getenv("KAFKA_TLS_CERT_FILE"),
+        KeyFile    : os.Getenv("KAFKA_TLS_KEY_FILE"),
+        ServerName : os.Getenv("KAFKA_TLS_SERVER_NAME"),
+        Insecure   : getBool("KAFKA_TLS_INSECURE"),
+        Sasl       : os.Getenv("KAFKA_SASL_MECHANISM"),
+        User       : GetSecret("KAFKA_SASL_USER"),
+        Password   : GetSecret("KAFKA_SASL_PASSWORD"),
+    }
+}
+
+// 根据配置设置kafka客户端的TLS加密及SASL认证
+func (o *Options) Apply(config *sarama.Config) error {
+    if o.Tls {
+        tlsConfig, err := o.TlsConfig()
+        if err != nil {
+            return err
+        }
+        config.Net.TLS.Enable = true
+        config.Net.TLS.Config = tlsConfig
+    }
+    if o.Sasl == "" {
+        return nil
+    }
+    config.Net.SASL.Enable    = true
+    config.Net.SASL.Handshake = true
+    config.Net.SASL.User      = o.User
+    config.Net.SASL.Password  = o.Password
+    switch strings.ToUpper(o.Sasl) {
+    case sarama.SASLTypePlaintext:
+        config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+    case sarama.SASLTypeSCRAMSHA256:
+        config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+        config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+            return &scramClient{HashGeneratorFcn : scram.SHA256}
+        }
+    case sarama.SASLTypeSCRAMSHA512:
+        config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+        config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+            return &scramClient{HashGeneratorFcn : scramSHA512}
+        }
+    default:
+        return errors.New("unsupported sasl mechanism: " + o.Sasl)
+    }
+    return nil
+}
+
+// 创建kafka客户端的TLS配置
+func (o *Options) TlsConfig() (*tls.Config, error) {
+    tlsConfig := &tls.Config {
+        ServerName         : o.ServerName,
+        InsecureSkipVerify : o.Insecure,
+    }
+    if o.CaFile != "" {
+        content, err := ioutil.ReadFile(o.CaFile)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(content) {
+            return nil, errors.New("invalid kafka ca file: " + o.CaFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+    if o.CertFile != "" || o.KeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+        if err != nil {
+            return nil, err
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+    return tlsConfig, nil
+}
+
+// 读取敏感配置，优先从<name>_FILE环境变量指定的文件中读取(例如kubernetes secret挂载的文件)，其次从<name>环境变量读取
+func GetSecret(name string) string {
+    if path := os.Getenv(name + "_FILE"); path != "" {
+        content, _ := ioutil.ReadFile(path)
+        return strings.TrimSpace(string(content))
+    }
+    return os.Getenv(name)
+}
+
+// 读取布尔类型的环境变量，为空或者无法解析时为false
+func getBool(name string) bool {
+    b, _ := strconv.ParseBool(os.Getenv(name))
+    return b
+}
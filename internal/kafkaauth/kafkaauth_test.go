@@ -0,0 +1,291 @@
+package kafkaauth
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "github.com/Shopify/sarama"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+const (
+    TEST_SERVER_NAME = "kafka.test" // 测试broker证书中的域名
+    TEST_CLIENT_NAME = "log-agent"  // 测试客户端证书的CN
+)
+
+// 测试使用的自签名CA及其签发的服务端、客户端证书
+type testCerts struct {
+    dir        string
+    caFile     string
+    certFile   string
+    keyFile    string
+    caPool     *x509.CertPool
+    serverCert tls.Certificate
+}
+
+// 生成证书并写入临时目录
+func newTestCerts(t *testing.T) *testCerts {
+    dir, err := ioutil.TempDir("", "kafkaauth")
+    if err != nil {
+        t.Fatal(err)
+    }
+    caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    caTemplate := &x509.Certificate {
+        SerialNumber          : big.NewInt(1),
+        Subject               : pkix.Name{CommonName : "test-ca"},
+        NotBefore             : time.Now().Add(-time.Hour),
+        NotAfter              : time.Now().Add(time.Hour),
+        IsCA                  : true,
+        KeyUsage              : x509.KeyUsageCertSign,
+        BasicConstraintsValid : true,
+    }
+    caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ca, _ := x509.ParseCertificate(caDer)
+    // 签发证书，返回PEM格式的证书及私钥
+    issue := func(serial int64, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+        key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        template := &x509.Certificate {
+            SerialNumber : big.NewInt(serial),
+            Subject      : pkix.Name{CommonName : name},
+            DNSNames     : []string{name},
+            NotBefore    : time.Now().Add(-time.Hour),
+            NotAfter     : time.Now().Add(time.Hour),
+            KeyUsage     : x509.KeyUsageDigitalSignature,
+            ExtKeyUsage  : []x509.ExtKeyUsage{usage},
+        }
+        der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+        if err != nil {
+            t.Fatal(err)
+        }
+        keyDer, err := x509.MarshalECPrivateKey(key)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return pem.EncodeToMemory(&pem.Block{Type : "CERTIFICATE", Bytes : der}),
+            pem.EncodeToMemory(&pem.Block{Type : "EC PRIVATE KEY", Bytes : keyDer})
+    }
+    c := &testCerts {
+        dir      : dir,
+        caFile   : filepath.Join(dir, "ca.pem"),
+        certFile : filepath.Join(dir, "client.pem"),
+        keyFile  : filepath.Join(dir, "client.key"),
+        caPool   : x509.NewCertPool(),
+    }
+    c.caPool.AddCert(ca)
+    serverPem, serverKey := issue(2, TEST_SERVER_NAME, x509.ExtKeyUsageServerAuth)
+    if c.serverCert, err = tls.X509KeyPair(serverPem, serverKey); err != nil {
+        t.Fatal(err)
+    }
+    clientPem, clientKey := issue(3, TEST_CLIENT_NAME, x509.ExtKeyUsageClientAuth)
+    files := map[string][]byte {
+        c.caFile   : pem.EncodeToMemory(&pem.Block{Type : "CERTIFICATE", Bytes : caDer}),
+        c.certFile : clientPem,
+        c.keyFile  : clientKey,
+    }
+    for path, content := range files {
+        if err := ioutil.WriteFile(path, content, 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return c
+}
+
+// 启动要求客户端证书的TLS监听作为测试broker，握手成功后返回客户端证书的CN
+func startTestBroker(t *testing.T, c *testCerts) (net.Listener, chan string) {
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config {
+        Certificates : []tls.Certificate{c.serverCert},
+        ClientCAs    : c.caPool,
+        ClientAuth   : tls.RequireAndVerifyClientCert,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    clients := make(chan string, 10)
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn *tls.Conn) {
+                defer conn.Close()
+                if err := conn.Handshake(); err != nil {
+                    return
+                }
+                clients <- conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+                conn.Write([]byte("ok"))
+            }(conn.(*tls.Conn))
+        }
+    }()
+    return ln, clients
+}
+
+// 使用配置连接测试broker，服务端拒绝客户端证书时在读取时返回错误
+func dialTestBroker(addr string, o *Options) error {
+    tlsConfig, err := o.TlsConfig()
+    if err != nil {
+        return err
+    }
+    conn, err := tls.DialWithDialer(&net.Dialer{Timeout : 5*time.Second}, "tcp", addr, tlsConfig)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5*time.Second))
+    _, err = conn.Read(make([]byte, 2))
+    return err
+}
+
+func TestTlsConfigAgainstBroker(t *testing.T) {
+    c := newTestCerts(t)
+    defer os.RemoveAll(c.dir)
+    ln, clients := startTestBroker(t, c)
+    defer ln.Close()
+    addr := ln.Addr().String()
+
+    // CA证书、客户端证书及服务端域名都正确时握手成功，broker收到客户端证书
+    o := &Options {
+        Tls        : true,
+        CaFile     : c.caFile,
+        CertFile   : c.certFile,
+        KeyFile    : c.keyFile,
+        ServerName : TEST_SERVER_NAME,
+    }
+    if err := dialTestBroker(addr, o); err != nil {
+        t.Fatalf("dial with full settings: %v", err)
+    }
+    select {
+    case name := <-clients:
+        if name != TEST_CLIENT_NAME {
+            t.Fatalf("broker got client certificate %q, want %q", name, TEST_CLIENT_NAME)
+        }
+    case <-time.After(5*time.Second):
+        t.Fatal("broker did not see the client certificate")
+    }
+
+    // 服务端域名与证书不一致时校验失败
+    wrongName := *o
+    wrongName.ServerName = "other.test"
+    if err := dialTestBroker(addr, &wrongName); err == nil {
+        t.Fatal("dial with wrong server name succeeded")
+    }
+
+    // 没有配置CA证书时使用系统证书，无法校验自签名证书
+    noCa := *o
+    noCa.CaFile = ""
+    if err := dialTestBroker(addr, &noCa); err == nil {
+        t.Fatal("dial without ca file succeeded")
+    }
+
+    // 跳过服务端证书校验时不需要CA证书
+    insecure := noCa
+    insecure.Insecure = true
+    if err := dialTestBroker(addr, &insecure); err != nil {
+        t.Fatalf("dial with insecure: %v", err)
+    }
+
+    // 没有客户端证书时broker拒绝连接
+    noCert := *o
+    noCert.CertFile = ""
+    noCert.KeyFile  = ""
+    if err := dialTestBroker(addr, &noCert); err == nil {
+        t.Fatal("dial without client certificate succeeded")
+    }
+}
+
+func TestTlsConfigInvalidFiles(t *testing.T) {
+    c := newTestCerts(t)
+    defer os.RemoveAll(c.dir)
+    // 私钥文件作为CA证书
+    if _, err := (&Options{CaFile : c.keyFile}).TlsConfig(); err == nil {
+        t.Fatal("invalid ca file accepted")
+    }
+    if _, err := (&Options{CaFile : filepath.Join(c.dir, "missing.pem")}).TlsConfig(); err == nil {
+        t.Fatal("missing ca file accepted")
+    }
+    // 只配置了证书没有配置私钥
+    if _, err := (&Options{CertFile : c.certFile}).TlsConfig(); err == nil {
+        t.Fatal("client certificate without key accepted")
+    }
+}
+
+func TestApply(t *testing.T) {
+    c := newTestCerts(t)
+    defer os.RemoveAll(c.dir)
+    config := sarama.NewConfig()
+    o := &Options {
+        Tls        : true,
+        CaFile     : c.caFile,
+        ServerName : TEST_SERVER_NAME,
+        Sasl       : "scram-sha-512",
+        User       : "user",
+        Password   : "password",
+    }
+    if err := o.Apply(config); err != nil {
+        t.Fatal(err)
+    }
+    if !config.Net.TLS.Enable || config.Net.TLS.Config == nil {
+        t.Fatal("tls not enabled")
+    }
+    if config.Net.TLS.Config.ServerName != TEST_SERVER_NAME || config.Net.TLS.Config.RootCAs == nil {
+        t.Fatal("tls server name or ca not applied")
+    }
+    if !config.Net.SASL.Enable || config.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 {
+        t.Fatalf("sasl mechanism %q not applied", config.Net.SASL.Mechanism)
+    }
+    if config.Net.SASL.User != "user" || config.Net.SASL.Password != "password" {
+        t.Fatal("sasl credentials not applied")
+    }
+    if config.Net.SASL.SCRAMClientGeneratorFunc == nil || config.Net.SASL.SCRAMClientGeneratorFunc() == nil {
+        t.Fatal("scram client not applied")
+    }
+
+    // 不启用TLS及SASL时不修改配置
+    config = sarama.NewConfig()
+    if err := (&Options{}).Apply(config); err != nil {
+        t.Fatal(err)
+    }
+    if config.Net.TLS.Enable || config.Net.SASL.Enable {
+        t.Fatal("security enabled without settings")
+    }
+
+    if err := (&Options{Sasl : "GSSAPI"}).Apply(sarama.NewConfig()); err == nil {
+        t.Fatal("unsupported sasl mechanism accepted")
+    }
+}
+
+func TestGetSecret(t *testing.T) {
+    dir, err := ioutil.TempDir("", "kafkaauth")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "password")
+    if err := ioutil.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    os.Setenv("KAFKAAUTH_TEST_SECRET", "from-env")
+    defer os.Unsetenv("KAFKAAUTH_TEST_SECRET")
+    if v := GetSecret("KAFKAAUTH_TEST_SECRET"); v != "from-env" {
+        t.Fatalf("got %q from env", v)
+    }
+    // _FILE优先，并去掉末尾的换行
+    os.Setenv("KAFKAAUTH_TEST_SECRET_FILE", path)
+    defer os.Unsetenv("KAFKAAUTH_TEST_SECRET_FILE")
+    if v := GetSecret("KAFKAAUTH_TEST_SECRET"); v != "from-file" {
+        t.Fatalf("got %q from file", v)
+    }
+}
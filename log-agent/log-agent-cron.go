@@ -43,8 +43,20 @@ func cleanLogCron() {
     }
 }
 
+// 记录日志文件真实提交成功的offset
+func saveFileOffset(path string, offset int64) {
+    offsetMapSave.Set(path, int(offset))
+    if v := fileFingerprintMap.Get(path); v != nil {
+        setFingerprintOffset(v.(*fileFingerprint).fp, offset)
+    }
+}
+
 // 定时保存日志文件的offset记录到文件中
 func saveOffsetCron() {
+    if rotatedGzip {
+        saveFingerprintMap()
+    }
+    saveSequenceMap()
     if offsetMapSave.Size() == 0 {
         return
     }
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "fmt"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gmlock"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gf/g/text/gregex"
+    "strings"
+    "sync"
+)
+
+const (
+    DEDUP_SUMMARY_CONTENT_SIZE = 200 // 重复统计记录中保留的原始记录内容长度
+)
+
+// 合并处理后需要发送的日志记录
+type dedupItem struct {
+    content string // 日志内容
+    end     int64  // 记录在源文件中的结束位置
+}
+
+// 日志记录流(日志文件或者其轮转压缩文件)的连续重复记录合并状态
+type dedupState struct {
+    mu      sync.Mutex
+    path    string         // 日志文件路径
+    key     string         // 当前记录的比较内容
+    content string         // 当前记录的原始内容
+    first   int64          // 当前记录第一次出现的时间(毫秒)
+    count   int            // 被合并的重复次数
+    end     int64          // 最后一条被合并记录的结束位置
+    window  int64          // 合并时间窗口(毫秒)
+    tracker *offsetTracker // 记录流的offset提交记录，用于超时输出重复统计
+}
+
+var (
+    // 日志记录流的重复记录合并状态，键名为getStreamKey生成的key
+    dedupMap = gmap.NewStringInterfaceMap()
+)
+
+// 获取重复记录比较使用的内容，默认为原始记录内容；
+// ignoreTime为true时去掉记录中的时间，使只有时间不同的记录也被视为重复
+func getDedupKey(content string, ignoreTime bool) string {
+    if !ignoreTime {
+        return content
+    }
+    key, _ := gregex.ReplaceString(`\d{4}[\-/]\d{2}[\-/]\d{2}[\sT]\d{2}:\d{2}:\d{2}([\.,]\d+)?(Z|[\+\-]\d{2}:?\d{2})?`, "", content)
+    return key
+}
+
+// 生成重复统计记录
+func buildDedupSummary(content string, count int) string {
+    content = strings.TrimRight(content, "\r\n")
+    if len(content) > DEDUP_SUMMARY_CONTENT_SIZE {
+        content = content[ : DEDUP_SUMMARY_CONTENT_SIZE] + "..."
+    }
+    return fmt.Sprintf("[log-agent] %s previous record repeated %d times: %s\n", gtime.Datetime(), count, content)
+}
+
+// 取出重复统计记录，没有被合并的记录时返回nil，需要在锁内调用
+func (s *dedupState) takeSummary() *dedupItem {
+    if s.count == 0 {
+        return nil
+    }
+    item := &dedupItem {
+        content : buildDedupSummary(s.content, s.count),
+        end     : s.end,
+    }
+    s.count = 0
+    return item
+}
+
+// 对日志记录进行连续重复合并处理，返回需要发送的记录(可能包含之前的重复统计记录)。
+// 时间窗口内与上一条记录相同的记录只计数不发送，出现不同的记录、时间窗口结束或者达到最大重复次数时输出重复统计。
+func dedupRecord(path string, content string, end int64, tracker *offsetTracker) []*dedupItem {
+    rule := getPathRule(path)
+    if rule.DedupWindow <= 0 {
+        return []*dedupItem{{content : content, end : end}}
+    }
+    // 日志文件与其轮转压缩文件的记录分别合并，重复统计只提交到所属记录流的offset
+    state := dedupMap.GetOrSetFuncLock(getStreamKey(path, tracker), func() interface{} {
+        return &dedupState {
+            path    : path,
+            window  : rule.DedupWindow*1000,
+            tracker : tracker,
+        }
+    }).(*dedupState)
+    state.mu.Lock()
+    defer state.mu.Unlock()
+    now   := gtime.Millisecond()
+    key   := getDedupKey(content, rule.DedupIgnoreTime)
+    items := make([]*dedupItem, 0, 2)
+    if key == state.key && now - state.first < state.window {
+        state.count++
+        state.end = end
+        if rule.DedupMaxCount > 0 && state.count >= rule.DedupMaxCount {
+            items = append(items, state.takeSummary())
+        }
+        return items
+    }
+    if item := state.takeSummary(); item != nil {
+        items = append(items, item)
+    }
+    state.key     = key
+    state.content = content
+    state.first   = now
+    return append(items, &dedupItem{content : content, end : end})
+}
+
+// 定时检查合并时间窗口已结束的重复记录，输出重复统计
+func flushDedupCron() {
+    for _, key := range dedupMap.Keys() {
+        if state, ok := dedupMap.Get(key).(*dedupState); ok {
+            flushDedupState(state, false)
+        }
+    }
+}
+
+// 输出记录流的重复统计，force为false时只输出时间窗口已结束的统计，文件正在搜集时由搜集流程处理
+func flushDedupState(state *dedupState, force bool) {
+    if !gmlock.TryLock(state.path) {
+        if !force {
+            return
+        }
+    } else {
+        defer gmlock.Unlock(state.path)
+    }
+    now := gtime.Millisecond()
+    state.mu.Lock()
+    var item *dedupItem
+    if force || now - state.first >= state.window {
+        item = state.takeSummary()
+    }
+    state.mu.Unlock()
+    if item != nil && limitRecord(state.path, item.content, item.end, state.tracker) {
+        pushRecord(state.path, item.content, item.end, state.tracker)
+    }
+}
+
+// 记录流结束(日志文件被删除或者轮转压缩文件处理完成)，输出尚未输出的重复统计后删除合并状态
+func removeDedupState(path string, tracker *offsetTracker) {
+    if state, ok := dedupMap.Remove(getStreamKey(path, tracker)).(*dedupState); ok {
+        flushDedupState(state, true)
+    }
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// 按照顺序添加测试日志记录，返回各记录的结束位置
+func emitTestContents(path string, contents ...string) []int64 {
+    tracker := getFileTracker(path)
+    ends    := make([]int64, len(contents))
+    end     := int64(0)
+    for i, content := range contents {
+        end    += int64(len(content))
+        ends[i] = end
+        emitRecord(path, content, end, tracker)
+    }
+    return ends
+}
+
+// 检查重复统计记录的重复次数及结束位置
+func checkDedupSummary(t *testing.T, record *logRecord, count string, end int64) {
+    if !strings.Contains(record.content, "repeated " + count + " times") || record.end != end {
+        t.Fatalf("summary %q at %d, want %s times at %d", record.content, record.end, count, end)
+    }
+}
+
+// 连续相同的记录合并为一条记录及重复统计，出现不同的记录时输出重复统计
+func TestDedupRecordCollapsesIdentical(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "dedup-identical")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.DedupWindow = 60
+    })
+    a    := "2018-08-08 13:01:55 ERROR connection refused\n"
+    b    := "2018-08-08 13:01:56 INFO recovered\n"
+    ends := emitTestContents(path, a, a, a, b)
+    records := takeTestLogRecords(queue)
+    if len(records) != 3 || records[0].content != a || records[2].content != b {
+        t.Fatalf("got %d records, want the record, the summary and the next record", len(records))
+    }
+    checkDedupSummary(t, records[1], "2", ends[2])
+}
+
+// 默认只合并内容完全相同的记录，开启dedupIgnoreTime后只有时间不同的记录也被合并
+func TestDedupRecordTimestamp(t *testing.T) {
+    a := "2018-08-08 13:01:55 ERROR connection refused\n"
+    b := "2018-08-08 13:01:56 ERROR connection refused\n"
+    c := "2018-08-08 13:01:57 ERROR connection refused\n"
+    path, queue, cleanup := newTestLogFile(t, "dedup-timestamp")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.DedupWindow = 60
+    })
+    emitTestContents(path, a, b, c)
+    checkTestRecords(t, queue, a, b, c)
+
+    ignored := path + ".ignore"
+    setTestRule(ignored, func(rule *pathRule) {
+        rule.DedupWindow     = 60
+        rule.DedupIgnoreTime = true
+    })
+    ends := emitTestContents(ignored, a, b, c)
+    removeDedupState(ignored, getFileTracker(ignored))
+    records := takeTestLogRecords(queue)
+    if len(records) != 2 || records[0].content != a {
+        t.Fatalf("got %d records, want the record and the summary", len(records))
+    }
+    checkDedupSummary(t, records[1], "2", ends[2])
+}
+
+// 达到最大重复次数后立即输出重复统计，之后的重复记录重新计数
+func TestDedupRecordMaxCount(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "dedup-max")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.DedupWindow   = 60
+        rule.DedupMaxCount = 2
+    })
+    a    := "2018-08-08 13:01:55 ERROR connection refused\n"
+    ends := emitTestContents(path, a, a, a, a)
+    records := takeTestLogRecords(queue)
+    if len(records) != 2 || records[0].content != a {
+        t.Fatalf("got %d records, want the record and the summary", len(records))
+    }
+    checkDedupSummary(t, records[1], "2", ends[2])
+    // 记录流结束时输出剩余的重复统计
+    removeDedupState(path, getFileTracker(path))
+    records = takeTestLogRecords(queue)
+    if len(records) != 1 {
+        t.Fatalf("got %d records after removing the state, want the summary", len(records))
+    }
+    checkDedupSummary(t, records[0], "1", ends[3])
+}
+
+// 合并时间窗口结束后由定时任务输出重复统计
+func TestFlushDedupCron(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "dedup-cron")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.DedupWindow = 60
+    })
+    a    := "2018-08-08 13:01:55 ERROR connection refused\n"
+    ends := emitTestContents(path, a, a)
+    flushDedupCron()
+    checkTestRecords(t, queue, a)
+    state := dedupMap.Get(getStreamKey(path, getFileTracker(path))).(*dedupState)
+    state.first -= state.window
+    flushDedupCron()
+    records := takeTestLogRecords(queue)
+    if len(records) != 1 {
+        t.Fatalf("got %d records after the window, want the summary", len(records))
+    }
+    checkDedupSummary(t, records[0], "1", ends[1])
+    removeDedupState(path, getFileTracker(path))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/htmlindex"
+    "golang.org/x/text/encoding/simplifiedchinese"
+    "golang.org/x/text/encoding/unicode"
+    "io"
+    "os"
+    "strings"
+    "unicode/utf8"
+)
+
+const (
+    ENCODING_AUTO        = "auto"     // 自动识别文件编码(UTF-16通过BOM识别，其他按行识别UTF-8或者GB18030)
+    ENCODING_UTF8        = "utf-8"
+    ENCODING_UTF16LE     = "utf-16le"
+    ENCODING_UTF16BE     = "utf-16be"
+    ENCODING_GB18030     = "gb18030"
+    ENCODING_DETECT_SIZE = 4          // (byte)自动识别编码时读取的文件头部内容大小(用于BOM判断)
+)
+
+var (
+    // 日志文件路径与实际使用的字符编码
+    fileEncodingMap = gmap.NewStringStringMap()
+    // 日志文件中无效字节被替换的次数统计，定时输出后清零
+    invalidByteMap  = gmap.NewStringIntMap()
+)
+
+// 获取日志文件的字符编码，自动识别的结果会缓存起来
+func getFileEncoding(path string, rule *pathRule) string {
+    name := strings.ToLower(rule.Encoding)
+    if name != ENCODING_AUTO {
+        return name
+    }
+    if v := fileEncodingMap.Get(path); v != "" {
+        return v
+    }
+    sample := readFileHead(path, ENCODING_DETECT_SIZE)
+    if len(sample) == 0 {
+        return ENCODING_AUTO
+    }
+    name = detectEncoding(sample)
+    glog.Debugfln("detect file encoding: %s, %s", path, name)
+    fileEncodingMap.Set(path, name)
+    return name
+}
+
+// 读取文件头部指定大小的内容，文件不足该大小时返回全部内容
+func readFileHead(path string, size int) []byte {
+    file, err := os.Open(path)
+    if err != nil {
+        glog.Error(err)
+        return nil
+    }
+    defer file.Close()
+    buffer := make([]byte, size)
+    n, _   := io.ReadFull(file, buffer)
+    return buffer[ : n]
+}
+
+// 根据文件头部内容识别字符编码：UTF-16需要通过BOM识别(按行读取时需要确定换行符)，
+// 其他情况按行识别，合法的UTF-8内容保持不变，否则按照GB18030解码。
+func detectEncoding(sample []byte) string {
+    switch {
+    case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+        return ENCODING_UTF16LE
+    case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+        return ENCODING_UTF16BE
+    }
+    return ENCODING_AUTO
+}
+
+// 从指定位置读取一行完整的日志内容(包含换行符)，返回内容及换行符最后一个字节的位置，没有完整的行时返回-1
+func readLogLine(path string, start int64, name string) ([]byte, int64) {
+    switch name {
+    case ENCODING_UTF16LE, ENCODING_UTF16BE:
+        return readUtf16Line(path, start, name == ENCODING_UTF16BE)
+    default:
+        return gfile.GetBinContentsTilCharByPath(path, '\n', start)
+    }
+}
+
+// 读取UTF-16编码文件中的一行，UTF-16的换行符为两个字节，不能直接按照'\n'字节查找
+func readUtf16Line(path string, start int64, bigEndian bool) ([]byte, int64) {
+    file, err := os.Open(path)
+    if err != nil {
+        glog.Error(err)
+        return nil, -1
+    }
+    defer file.Close()
+    reader := bufio.NewReader(io.NewSectionReader(file, start, gfile.Size(path) - start))
+    buffer := bytes.NewBuffer(nil)
+    unit   := make([]byte, 2)
+    for pos := start; ; pos += 2 {
+        if _, err := io.ReadFull(reader, unit); err != nil {
+            return nil, -1
+        }
+        buffer.Write(unit)
+        if (!bigEndian && unit[0] == '\n' && unit[1] == 0) || (bigEndian && unit[0] == 0 && unit[1] == '\n') {
+            return buffer.Bytes(), pos + 1
+        }
+    }
+}
+
+// 将日志行内容转换为UTF-8编码，无效的字节替换为U+FFFD并计数。
+// first表示该行是否为文件的第一行，第一行需要去掉BOM。
+func decodeLogLine(path string, content []byte, name string, rule *pathRule, first bool) []byte {
+    replaced := 0
+    if name == ENCODING_AUTO {
+        if utf8.Valid(content) {
+            name = ENCODING_UTF8
+        } else {
+            name = ENCODING_GB18030
+        }
+    }
+    switch name {
+    case "", ENCODING_UTF8, "utf8":
+        if first {
+            content = bytes.TrimPrefix(content, []byte{0xEF, 0xBB, 0xBF})
+        }
+        if !utf8.Valid(content) {
+            content, replaced = replaceInvalidUtf8(content)
+        }
+    default:
+        if decoded, err := getEncoding(name).NewDecoder().Bytes(content); err != nil {
+            glog.Error(path, err)
+        } else {
+            // 解码时无效的字节会被替换为U+FFFD，源内容中原本就有的U+FFFD不计入替换次数
+            replaced = bytes.Count(decoded, []byte(string(utf8.RuneError))) - countSourceRuneError(content, name)
+            content  = decoded
+            if first {
+                content = bytes.TrimPrefix(content, []byte("\uFEFF"))
+            }
+        }
+    }
+    if replaced > 0 {
+        invalidByteMap.LockFunc(func(m map[string]int) {
+            m[path] += replaced
+        })
+    }
+    if rule.Crlf && bytes.HasSuffix(content, []byte("\r\n")) {
+        content = append(content[ : len(content) - 2], '\n')
+    }
+    return content
+}
+
+// 获取字符编码的实现，不支持的编码按照GB18030处理
+func getEncoding(name string) encoding.Encoding {
+    switch name {
+    case ENCODING_UTF16LE:
+        return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+    case ENCODING_UTF16BE:
+        return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+    case ENCODING_GB18030:
+        return simplifiedchinese.GB18030
+    }
+    if e, err := htmlindex.Get(name); err == nil {
+        return e
+    }
+    glog.Error("unsupported encoding:", name)
+    return simplifiedchinese.GB18030
+}
+
+// 统计源内容中合法编码的U+FFFD数量(UTF-16按照两个字节对齐比较)，编码不支持U+FFFD时返回0
+func countSourceRuneError(content []byte, name string) int {
+    encoded, err := getEncoding(name).NewEncoder().Bytes([]byte(string(utf8.RuneError)))
+    if err != nil || len(encoded) == 0 {
+        return 0
+    }
+    if name != ENCODING_UTF16LE && name != ENCODING_UTF16BE {
+        return bytes.Count(content, encoded)
+    }
+    count := 0
+    for i := 0; i + 1 < len(content); i += 2 {
+        if content[i] == encoded[0] && content[i + 1] == encoded[1] {
+            count++
+        }
+    }
+    return count
+}
+
+// 替换内容中无效的UTF-8字节为U+FFFD，返回替换后的内容及替换次数
+func replaceInvalidUtf8(content []byte) ([]byte, int) {
+    buffer   := bytes.NewBuffer(make([]byte, 0, len(content) + 16))
+    replaced := 0
+    for len(content) > 0 {
+        r, size := utf8.DecodeRune(content)
+        if r == utf8.RuneError && size == 1 {
+            buffer.WriteRune(utf8.RuneError)
+            replaced++
+        } else {
+            buffer.Write(content[ : size])
+        }
+        content = content[size : ]
+    }
+    return buffer.Bytes(), replaced
+}
+
+// 定时输出日志文件的无效字节替换统计
+func reportInvalidByteCron() {
+    if invalidByteMap.Size() == 0 {
+        return
+    }
+    invalidByteMap.LockFunc(func(m map[string]int) {
+        for path, count := range m {
+            glog.Println("invalid bytes replaced:", path, count)
+            delete(m, path)
+        }
+    })
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "golang.org/x/text/encoding/simplifiedchinese"
+    "golang.org/x/text/encoding/unicode"
+    "os"
+    "testing"
+)
+
+// 为测试日志文件设置搜集规则
+func setTestRule(path string, set func(rule *pathRule)) {
+    rule := newDefaultRule()
+    set(rule)
+    pathRuleMap.Set(path, rule)
+}
+
+// 使用指定编码器编码测试内容
+func encodeTestContent(t *testing.T, content string, encode func(string) (string, error)) string {
+    encoded, err := encode(content)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return encoded
+}
+
+// GB18030编码的日志转换为UTF-8后再进行多行判断
+func TestCheckLogFileConvertsGb18030(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "encoding-gb18030")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.Encoding = ENCODING_GB18030
+    })
+    first  := "2018-08-08 13:01:55 INFO 订单创建成功\n"
+    second := "2018-08-08 13:01:56 INFO 支付完成\n"
+    appendTestLog(t, path, encodeTestContent(t, first + second, simplifiedchinese.GB18030.NewEncoder().String))
+    checkLogFile(path)
+    flushPendingRecord(path, true)
+    checkTestRecords(t, queue, first, second)
+}
+
+// 自动识别带有BOM的UTF-16文件，去掉BOM后转换为UTF-8
+func TestCheckLogFileDetectsUtf16Bom(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "encoding-utf16")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.Encoding = ENCODING_AUTO
+    })
+    first  := "2018-08-08 13:01:55 INFO 开始\n"
+    second := "2018-08-08 13:01:56 INFO 结束\n"
+    encoder := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder()
+    appendTestLog(t, path, encodeTestContent(t, first + second, encoder.String))
+    checkLogFile(path)
+    flushPendingRecord(path, true)
+    checkTestRecords(t, queue, first, second)
+}
+
+// 只统计解码时替换的无效字节，源内容中合法编码的U+FFFD不计入
+func TestDecodeLogLineCountsReplacements(t *testing.T) {
+    rule := newDefaultRule()
+    path := "/test/encoding-replacement.log"
+    // UTF-8: 两个无效字节，一个原本就有的U+FFFD
+    invalidByteMap.Remove(path)
+    content := decodeLogLine(path, []byte("a\xff�b\xfe\n"), ENCODING_UTF8, rule, false)
+    if string(content) != "a��b�\n" {
+        t.Fatalf("decoded %q", content)
+    }
+    if count := invalidByteMap.Get(path); count != 2 {
+        t.Fatalf("utf-8 replaced %d bytes, want 2", count)
+    }
+    // GB18030: 一个无效字节，一个原本就有的U+FFFD
+    invalidByteMap.Remove(path)
+    source := encodeTestContent(t, "错误�", simplifiedchinese.GB18030.NewEncoder().String) + "\xff\n"
+    content = decodeLogLine(path, []byte(source), ENCODING_GB18030, rule, false)
+    if string(content) != "错误��\n" {
+        t.Fatalf("decoded %q", content)
+    }
+    if count := invalidByteMap.Get(path); count != 1 {
+        t.Fatalf("gb18030 replaced %d bytes, want 1", count)
+    }
+    // UTF-16: 原本就有的U+FFFD不计入
+    invalidByteMap.Remove(path)
+    source = encodeTestContent(t, "a�\n", unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().String)
+    decodeLogLine(path, []byte(source), ENCODING_UTF16LE, rule, false)
+    if count := invalidByteMap.Get(path); count != 0 {
+        t.Fatalf("utf-16 replaced %d bytes, want 0", count)
+    }
+    invalidByteMap.Remove(path)
+}
+
+// 默认保留CRLF行尾，规则开启crlf后转换为LF
+func TestDecodeLogLineCrlf(t *testing.T) {
+    rule := newDefaultRule()
+    if rule.Crlf {
+        t.Fatal("crlf normalisation enabled by default")
+    }
+    path := "/test/encoding-crlf.log"
+    if content := decodeLogLine(path, []byte("line\r\n"), ENCODING_UTF8, rule, false); string(content) != "line\r\n" {
+        t.Fatalf("decoded %q with crlf off", content)
+    }
+    rule.Crlf = true
+    if content := decodeLogLine(path, []byte("line\r\n"), ENCODING_UTF8, rule, false); string(content) != "line\n" {
+        t.Fatalf("decoded %q with crlf on", content)
+    }
+}
+
+// 文件被截断后重新识别字符编码，并使用新的文件标识从头开始搜集
+func TestCheckLogFileResetsEncodingOnTruncate(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "encoding-truncate")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.Encoding = ENCODING_AUTO
+    })
+    first   := "2018-08-08 13:01:55 INFO utf-16 first\n"
+    second  := "2018-08-08 13:01:56 INFO utf-16 second\n"
+    encoder := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder()
+    appendTestLog(t, path, encodeTestContent(t, first + second, encoder.String))
+    checkLogFile(path)
+    checkTestRecords(t, queue, first)
+    epoch := getFileTracker(path).epoch
+    if err := os.Truncate(path, 0); err != nil {
+        t.Fatal(err)
+    }
+    third := "2018-08-08 13:02:00 INFO utf-8\n"
+    appendTestLog(t, path, third)
+    checkLogFile(path)
+    // 截断前未完整的记录直接提交
+    checkTestRecords(t, queue, second)
+    if name := fileEncodingMap.Get(path); name != ENCODING_AUTO {
+        t.Fatalf("encoding %q after truncate, want %q", name, ENCODING_AUTO)
+    }
+    if getFileTracker(path).epoch == epoch {
+        t.Fatal("file epoch not changed after truncate")
+    }
+    if offset := offsetMapCache.Get(path); offset != len(third) {
+        t.Fatalf("offset %d after truncate, want %d", offset, len(third))
+    }
+    flushPendingRecord(path, true)
+    checkTestRecords(t, queue, third)
+}
@@ -1,87 +1,322 @@
 package main
 
 import (
+    "container/list"
+    "fmt"
+    "github.com/Shopify/sarama"
     "github.com/gogf/gf/g/container/gmap"
     "github.com/gogf/gf/g/encoding/gjson"
     "github.com/gogf/gf/g/os/glog"
     "github.com/gogf/gf/g/os/gtime"
     "github.com/gogf/gf/g/text/gregex"
-    "github.com/gogf/gkafka"
+    "hash/fnv"
+    "math"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
+// 待发送的日志记录
+type logRecord struct {
+    path    string         // 日志文件路径
+    content string         // 日志内容
+    start   int64          // 记录在源文件中的起始位置
+    end     int64          // 记录在源文件中的结束位置
+    tracker *offsetTracker // 源文件的offset提交记录
+    element *list.Element  // 记录在offset提交记录中的位置
+}
+
+// 一条kafka消息(可能被拆分为多个包)，所有分包都被确认后消息中的日志记录才被确认。
+// 消息中的日志记录属于同一个源文件，并且在源文件中是连续的。
+type messageUnit struct {
+    topic     string
+    records   []*logRecord
+    tracker   *offsetTracker // 源文件的offset提交记录
+    seq       int64          // 消息在源文件中的序列号
+    remaining int            // 未确认的分包数量
+    failed    bool           // 是否有分包发送失败
+    done      func()         // 消息被确认后的回调
+}
+
 var (
-    // kafka消息生产者map
-    producers = gmap.NewStringInterfaceMap()
+    // kafka异步生产者，所有topic共用
+    producer     sarama.AsyncProducer
+    producerOnce sync.Once
+    // 每个topic的发送队列
+    queueMap     = gmap.NewStringInterfaceMap()
 )
 
-// 创建kafka生产客户端
-func getKafkaClientProducer(topic string) *gkafka.Client {
-    if kafkaAddr == "" {
-        panic("incomplete kafka settings")
-    }
-    return producers.GetOrSetFuncLock(topic, func() interface{} {
-        kafkaConfig               := gkafka.NewConfig()
-        kafkaConfig.Servers        = kafkaAddr
-        kafkaConfig.Topics         = topic
-        return gkafka.NewClient(kafkaConfig)
-    }).(*gkafka.Client)
+// 根据日志文件路径获取对应的kafka topic
+func getTopicFromPath(path string) string {
+    match, _ := gregex.MatchString(`.+kubernetes\.io~empty\-dir/log.*?/(.+?)/.+`, path)
+    if len(match) > 1 {
+        return match[1]
+    }
+    return ""
 }
 
-// 向kafka发送日志内容(异步)
-// 如果发送失败，那么每隔1秒阻塞重试
-func sendToKafka(path string, msgs []string, offset int64) {
-    defer offsetMapSave.Set(path, int(offset) + 1)
-    msg := Message{
-        Path : path,
-        Msgs : msgs,
-        Time : gtime.Now().String(),
-        Host : hostname,
+// 根据节点主机名称及日志文件路径生成kafka消息的key，
+// 同一日志文件的消息使用相同的key，kafka会将其写入同一个partition，从而保证消息的顺序
+func getMessageKey(path string) string {
+    h := fnv.New64a()
+    h.Write([]byte(hostname + ":" + path))
+    return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// 获取kafka异步生产者
+func getProducer() sarama.AsyncProducer {
+    producerOnce.Do(func() {
+        if kafkaAddr == "" {
+            panic("incomplete kafka settings")
+        }
+        config := sarama.NewConfig()
+        config.Producer.Return.Successes = true
+        config.Producer.Return.Errors    = true
+        config.Producer.RequiredAcks     = getRequiredAcks(kafkaAcks)
+        config.Producer.Partitioner      = sarama.NewHashPartitioner
+        config.Producer.Flush.Frequency  = time.Duration(lingerTime)*time.Millisecond
+        config.Producer.Flush.Bytes      = batchBytes
+        // 发送失败时由生产者按照顺序重试(kafka不可用时一直重试)，每个broker连接只允许一个未确认的请求，
+        // 保证同一文件(同一key)的分包及批次不会因为重试而乱序
+        config.Producer.Retry.Max        = math.MaxInt32
+        config.Producer.Retry.Backoff    = time.Second
+        config.Net.MaxOpenRequests       = 1
+        if err := kafkaAuth.Apply(config); err != nil {
+            panic(err)
+        }
+        for {
+            if p, err := sarama.NewAsyncProducer(strings.Split(kafkaAddr, ","), config); err != nil {
+                glog.Error(err)
+                time.Sleep(time.Second)
+            } else {
+                producer = p
+                break
+            }
+        }
+        go handleProducerResults()
+    })
+    return producer
+}
+
+// 根据配置获取kafka的消息确认级别：all(所有副本确认), 1(leader确认), 0(不等待确认)
+func getRequiredAcks(acks string) sarama.RequiredAcks {
+    switch acks {
+    case "0":
+        return sarama.NoResponse
+    case "1":
+        return sarama.WaitForLocal
+    default:
+        return sarama.WaitForAll
     }
-    topic    := ""
-    match, _ := gregex.MatchString(`.+kubernetes\.io~empty\-dir/log.*?/(.+?)/.+`, path)
-    if len(match) > 1 {
-        topic = match[1]
+}
+
+// 获取topic的发送队列，队列不存在时创建队列及对应的发送协程
+func getTopicQueue(topic string) chan *logRecord {
+    return queueMap.GetOrSetFuncLock(topic, func() interface{} {
+        queue := make(chan *logRecord, queueSize)
+        go handleTopicQueue(topic, queue)
+        return queue
+    }).(chan *logRecord)
+}
+
+// 提交一条完整的日志记录，经过重复记录合并及限流处理后放入发送队列
+func emitRecord(path string, content string, end int64, tracker *offsetTracker) {
+    for _, record := range dedupRecord(path, content, end, tracker) {
+        if limitRecord(path, record.content, record.end, tracker) {
+            pushRecord(path, record.content, record.end, tracker)
+        }
+    }
+}
+
+// 将日志记录放入对应topic的发送队列，队列满时阻塞等待(对文件搜集形成反压)
+func pushRecord(path string, content string, end int64, tracker *offsetTracker) {
+    record := &logRecord {
+        path    : path,
+        content : content,
+        end     : end,
+        tracker : tracker,
     }
+    record.element, record.start = tracker.add(end)
+    getTopicQueue(getTopicFromPath(path)) <- record
+}
+
+// topic发送队列处理循环，日志内容达到批量大小或者等待时间超过LINGER_MS时批量发送
+func handleTopicQueue(topic string, queue chan *logRecord) {
+    ticker   := time.NewTicker(time.Duration(lingerTime)*time.Millisecond)
+    inFlight := make(chan struct{}, maxInFlight)
+    records  := make([]*logRecord, 0)
+    size     := 0
     for {
-        if msgBytes, err := gjson.Encode(msg); err != nil {
-            glog.Error(err)
-        } else {
-            id    := gtime.Nanosecond()
-            total := int(len(msgBytes)/sendMaxSize) + 1
-            // 如果消息超过限制的大小，那么进行拆包
-            for seq := 1; seq <= total; seq++ {
-                pkg := Package {
-                    Id    : id,
-                    Seq   : seq,
-                    Total : total,
-                }
-                pos := (seq - 1)*sendMaxSize
-                if seq == total {
-                    pkg.Msg = msgBytes[pos : ]
-                } else {
-                    pkg.Msg = msgBytes[pos : pos + sendMaxSize]
-                }
-                for {
-                    if pkgBytes, err := gjson.Encode(pkg); err != nil {
-                        glog.Error(err)
-                    } else {
-                        start := offsetMapSave.Get(path)
-                        if start > int(offset) {
-                            start = 0
-                        }
-                        glog.Debugfln("%s %s,\t%d to %d,\t%d[%d:%d]", topic, path, start, offset, len(msgBytes), pos, pos + len(pkg.Msg))
-                        if err := getKafkaClientProducer(topic).SyncSend(&gkafka.Message{Value : pkgBytes}); err != nil {
-                            glog.Error(err)
-                        } else {
-                            break
-                        }
-                        time.Sleep(time.Second)
-                    }
+        select {
+        case record := <-queue:
+            records = append(records, record)
+            size   += len(record.content)
+            if size < batchBytes {
+                continue
+            }
+        case <-ticker.C:
+            if len(records) == 0 {
+                continue
+            }
+        }
+        sendBatch(topic, records, inFlight)
+        records = make([]*logRecord, 0)
+        size    = 0
+    }
+}
+
+// 将一批日志记录按照源文件组装为消息并异步发送，单条消息的内容不超过SEND_MAX_SIZE。
+// 已发送未确认的批次数量达到MAX_IN_FLIGHT时阻塞等待。
+func sendBatch(topic string, records []*logRecord, inFlight chan struct{}) {
+    inFlight <- struct{}{}
+    groups  := make([][]*logRecord, 0)
+    indexes := make(map[*offsetTracker]int)
+    sizes   := make(map[*offsetTracker]int)
+    for _, record := range records {
+        index, ok := indexes[record.tracker]
+        if !ok || (sizes[record.tracker] > 0 && sizes[record.tracker] + len(record.content) > sendMaxSize) {
+            index = len(groups)
+            groups = append(groups, make([]*logRecord, 0))
+            indexes[record.tracker] = index
+            sizes[record.tracker]   = 0
+        }
+        groups[index]          = append(groups[index], record)
+        sizes[record.tracker] += len(record.content)
+    }
+    remaining := int32(len(groups))
+    for _, group := range groups {
+        sendMessage(&messageUnit {
+            topic   : topic,
+            records : group,
+            tracker : group[0].tracker,
+            seq     : group[0].tracker.nextSeq(),
+            done    : func() {
+                // 确认回调可能在发送结果协程或者发送协程(编码失败时)中执行
+                if atomic.AddInt32(&remaining, -1) == 0 {
+                    <- inFlight
                 }
+            },
+        })
+    }
+}
+
+// 向kafka异步发送一条日志消息，如果消息超过限制的大小，那么进行拆包
+func sendMessage(unit *messageUnit) {
+    topic := unit.topic
+    msg := Message{
+        Path  : unit.records[0].path,
+        Msgs  : make([]string, len(unit.records)),
+        Ends  : make([]int64, len(unit.records)),
+        Time  : gtime.Now().String(),
+        Host  : hostname,
+        Epoch : unit.tracker.epoch,
+        Seq   : unit.seq,
+        Start : unit.records[0].start,
+        End   : unit.records[len(unit.records) - 1].end,
+    }
+    meta := getPodMeta(msg.Path)
+    msg.Namespace = meta.namespace
+    msg.Pod       = meta.pod
+    msg.Container = meta.container
+    msg.Rotated   = unit.tracker.rotated
+    for i, record := range unit.records {
+        msg.Msgs[i] = record.content
+        msg.Ends[i] = record.end
+    }
+    msgBytes, err := gjson.Encode(msg)
+    if err != nil {
+        go retryMessage(unit, err)
+        return
+    }
+    // 全部分包编码成功后才开始发送，编码失败时不会有部分分包已经发送
+    key      := sarama.StringEncoder(getMessageKey(msg.Path))
+    id       := gtime.Nanosecond()
+    total    := int(len(msgBytes)/sendMaxSize) + 1
+    packages := make([][]byte, total)
+    for seq := 1; seq <= total; seq++ {
+        pkg := Package {
+            Id    : id,
+            Seq   : seq,
+            Total : total,
+        }
+        pos := (seq - 1)*sendMaxSize
+        if seq == total {
+            pkg.Msg = msgBytes[pos : ]
+        } else {
+            pkg.Msg = msgBytes[pos : pos + sendMaxSize]
+        }
+        pkgBytes, err := gjson.Encode(pkg)
+        if err != nil {
+            go retryMessage(unit, err)
+            return
+        }
+        packages[seq - 1] = pkgBytes
+        glog.Debugfln("%s %s,\t%d[%d:%d]", topic, msg.Path, len(msgBytes), pos, pos + len(pkg.Msg))
+    }
+    unit.remaining = total
+    unit.failed    = false
+    for _, pkgBytes := range packages {
+        getProducer().Input() <- &sarama.ProducerMessage {
+            Topic    : topic,
+            Key      : key,
+            Value    : sarama.ByteEncoder(pkgBytes),
+            Metadata : unit,
+        }
+    }
+}
+
+// 消息无法发送(编码失败或者生产者重试后仍然失败)，每隔1秒重新发送直到kafka确认。
+// 期间不确认其中的日志记录，也不释放批次，该文件的offset不会越过未被kafka接收的记录，
+// 未确认的批次达到MAX_IN_FLIGHT后该topic的发送协程阻塞等待(对文件搜集形成反压)。
+// 部分分包已经发送成功时，转储端会忽略重复的分包及日志记录。
+func retryMessage(unit *messageUnit, err error) {
+    glog.Errorfln("resend message of %s [%d:%d], seq %d: %v",
+        unit.records[0].path, unit.records[0].start, unit.records[len(unit.records) - 1].end, unit.seq, err)
+    time.Sleep(time.Second)
+    sendMessage(unit)
+}
+
+// 处理kafka的发送结果，所有分包都有结果后推进日志记录的offset。
+// 成功及失败在同一个协程中处理，分包计数不需要加锁。
+func handleProducerResults() {
+    successes := producer.Successes()
+    errors    := producer.Errors()
+    for successes != nil || errors != nil {
+        select {
+        case msg, ok := <-successes:
+            if !ok {
+                successes = nil
+                continue
+            }
+            handleProducerResult(msg.Metadata.(*messageUnit), nil)
+        case err, ok := <-errors:
+            if !ok {
+                errors = nil
+                continue
             }
-            break
+            handleProducerResult(err.Msg.Metadata.(*messageUnit), err.Err)
         }
     }
 }
 
+// 处理一个分包的发送结果，生产者已经按照顺序重试过仍然失败的消息重新发送
+func handleProducerResult(unit *messageUnit, err error) {
+    if err != nil {
+        glog.Error(err)
+        unit.failed = true
+    }
+    if unit.remaining--; unit.remaining > 0 {
+        return
+    }
+    if unit.failed {
+        // 不能在发送结果协程中阻塞写入生产者，否则发送结果无法被读取
+        go retryMessage(unit, fmt.Errorf("kafka producer failed after retries"))
+        return
+    }
+    for _, record := range unit.records {
+        record.tracker.ack(record.element)
+    }
+    unit.tracker.ackSeq(unit.seq)
+    unit.done()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/Shopify/sarama"
+    "github.com/Shopify/sarama/mocks"
+    "testing"
+    "time"
+)
+
+// 使用模拟的kafka生产者，发送的消息全部成功并返回到Successes中
+func setTestProducer(t *testing.T, expected int) *mocks.AsyncProducer {
+    config := sarama.NewConfig()
+    config.Producer.Return.Successes = true
+    p := mocks.NewAsyncProducer(t, config)
+    for i := 0; i < expected; i++ {
+        p.ExpectInputAndSucceed()
+    }
+    producerOnce.Do(func() {})
+    producer = p
+    return p
+}
+
+// 同一节点的同一日志文件使用相同的key，不同的日志文件使用不同的key
+func TestGetMessageKey(t *testing.T) {
+    a := getMessageKey("/var/log/a.log")
+    if a != getMessageKey("/var/log/a.log") {
+        t.Fatal("message key is not stable")
+    }
+    if a == getMessageKey("/var/log/b.log") {
+        t.Fatal("different files share the same message key")
+    }
+}
+
+// 消息被拆包后所有分包使用文件的key并按照顺序发送，kafka将其写入同一个partition
+func TestSendMessageKeysAllPackages(t *testing.T) {
+    defer func(size int) {
+        sendMaxSize = size
+    }(sendMaxSize)
+    sendMaxSize = 64
+    p       := setTestProducer(t, 100)
+    path    := "/var/log/kubernetes.io~empty-dir/log/keyed/app.log"
+    tracker := newOffsetTracker(1, 0, 0, func(offset int64) {})
+    records := make([]*logRecord, 0)
+    for i, end := 0, int64(0); i < 3; i++ {
+        content := fmt.Sprintf("2018-08-08 13:01:5%d INFO record %d with enough content to split\n", i, i)
+        end     += int64(len(content))
+        record  := &logRecord{path : path, content : content, end : end, tracker : tracker}
+        record.element, record.start = tracker.add(end)
+        records = append(records, record)
+    }
+    sendMessage(&messageUnit {
+        topic   : "keyed",
+        records : records,
+        tracker : tracker,
+        seq     : tracker.nextSeq(),
+        done    : func() {},
+    })
+    key := getMessageKey(path)
+    id  := int64(0)
+    for seq, total := 1, 1; seq <= total; seq++ {
+        var msg *sarama.ProducerMessage
+        select {
+        case msg = <-p.Successes():
+        case <-time.After(5*time.Second):
+            t.Fatalf("package %d not sent", seq)
+        }
+        if k, _ := msg.Key.Encode(); string(k) != key {
+            t.Fatalf("package %d has key %q, want %q", seq, k, key)
+        }
+        value, _ := msg.Value.Encode()
+        pkg      := &Package{}
+        if err := json.Unmarshal(value, pkg); err != nil {
+            t.Fatal(err)
+        }
+        if seq == 1 {
+            id, total = pkg.Id, pkg.Total
+            if total < 2 {
+                t.Fatalf("message split into %d packages, want more than 1", total)
+            }
+        }
+        if pkg.Id != id || pkg.Seq != seq || pkg.Total != total {
+            t.Fatalf("got package %d/%d of %d, want %d/%d of %d", pkg.Seq, pkg.Total, pkg.Id, seq, total, id)
+        }
+    }
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+    "fmt"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "sync"
+    "time"
+)
+
+const (
+    LIMIT_POLICY_BLOCK = "block" // 超过速率限制时阻塞文件搜集，直到获得足够的令牌
+    LIMIT_POLICY_DROP  = "drop"  // 超过速率限制时丢弃日志记录，并在下一条记录前插入丢弃统计记录
+)
+
+// 令牌桶，每秒产生rate个令牌，桶的容量为rate(允许1秒的突发流量)
+type tokenBucket struct {
+    mu     sync.Mutex
+    rate   float64   // 每秒产生的令牌数量
+    tokens float64   // 当前令牌数量，阻塞模式下可以为负数(表示预支的令牌)
+    last   time.Time // 最后一次计算令牌的时间
+}
+
+// 限流器，分别按照字节数及记录数限制，为nil的令牌桶表示不限制
+type rateLimiter struct {
+    bytes   *tokenBucket
+    records *tokenBucket
+}
+
+// 日志记录流(日志文件或者其轮转压缩文件)的限流器及丢弃统计
+type fileLimiter struct {
+    rateLimiter
+    mu           sync.Mutex
+    dropped      int   // 丢弃的记录数量(尚未插入统计记录)
+    droppedBytes int   // 丢弃的字节数量(尚未插入统计记录)
+    droppedEnd   int64 // 最后一条丢弃记录的结束位置
+}
+
+var (
+    // 日志记录流的限流器，键名为getStreamKey生成的key
+    fileLimiterMap  = gmap.NewStringInterfaceMap()
+    // topic的限流器
+    topicLimiterMap = gmap.NewStringInterfaceMap()
+    // 日志文件被丢弃的记录数量统计，定时输出后清零
+    droppedMap      = gmap.NewStringIntMap()
+)
+
+// 创建令牌桶，rate不大于0时返回nil
+func newTokenBucket(rate int64) *tokenBucket {
+    if rate <= 0 {
+        return nil
+    }
+    return &tokenBucket {
+        rate   : float64(rate),
+        tokens : float64(rate),
+        last   : time.Now(),
+    }
+}
+
+// 按照时间补充令牌，需要在锁内调用
+func (b *tokenBucket) refill() {
+    now     := time.Now()
+    b.tokens += now.Sub(b.last).Seconds()*b.rate
+    b.last   = now
+    if b.tokens > b.rate {
+        b.tokens = b.rate
+    }
+}
+
+// 预支n个令牌，返回获得令牌需要等待的时间
+func (b *tokenBucket) reserve(n int) time.Duration {
+    if b == nil {
+        return 0
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.refill()
+    b.tokens -= float64(n)
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens/b.rate*float64(time.Second))
+}
+
+// 判断是否有足够的令牌。令牌桶已满时总是允许，防止超过桶容量的记录永远无法通过
+func (b *tokenBucket) allow(n int) bool {
+    if b == nil {
+        return true
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.refill()
+    return b.tokens >= float64(n) || b.tokens >= b.rate
+}
+
+// 扣除n个令牌
+func (b *tokenBucket) take(n int) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.tokens -= float64(n)
+    b.mu.Unlock()
+}
+
+// 获取日志记录流的限流器
+func getFileLimiter(key string, rule *pathRule) *fileLimiter {
+    return fileLimiterMap.GetOrSetFuncLock(key, func() interface{} {
+        return &fileLimiter{rateLimiter : rateLimiter {
+            bytes   : newTokenBucket(rule.FileByteRate),
+            records : newTokenBucket(rule.FileRecordRate),
+        }}
+    }).(*fileLimiter)
+}
+
+// 获取topic的限流器
+func getTopicLimiter(topic string, rule *pathRule) *rateLimiter {
+    return topicLimiterMap.GetOrSetFuncLock(topic, func() interface{} {
+        return &rateLimiter {
+            bytes   : newTokenBucket(rule.TopicByteRate),
+            records : newTokenBucket(rule.TopicRecordRate),
+        }
+    }).(*rateLimiter)
+}
+
+// 对日志记录进行限流处理，返回是否继续发送该记录。
+// block策略下阻塞等待直到获得足够的令牌(调用方持有文件锁，从而对该文件的搜集形成反压)；
+// drop策略下丢弃超过限制的记录，并在下一条允许发送的记录之前插入一条丢弃统计记录。
+func limitRecord(path string, content string, end int64, tracker *offsetTracker) bool {
+    rule  := getPathRule(path)
+    file  := getFileLimiter(getStreamKey(path, tracker), rule)
+    topic := getTopicLimiter(getTopicFromPath(path), rule)
+    size  := len(content)
+    if rule.LimitPolicy != LIMIT_POLICY_DROP {
+        wait := file.bytes.reserve(size)
+        for _, d := range []time.Duration {
+            file.records.reserve(1),
+            topic.bytes.reserve(size),
+            topic.records.reserve(1),
+        } {
+            if d > wait {
+                wait = d
+            }
+        }
+        if wait > 0 {
+            time.Sleep(wait)
+        }
+        return true
+    }
+    file.mu.Lock()
+    defer file.mu.Unlock()
+    if !file.bytes.allow(size) || !file.records.allow(1) || !topic.bytes.allow(size) || !topic.records.allow(1) {
+        file.dropped++
+        file.droppedBytes += size
+        file.droppedEnd    = end
+        droppedMap.LockFunc(func(m map[string]int) {
+            m[path]++
+        })
+        return false
+    }
+    file.bytes.take(size)
+    file.records.take(1)
+    topic.bytes.take(size)
+    topic.records.take(1)
+    file.flushDropped(path, tracker)
+    return true
+}
+
+// 在下一条记录之前插入丢弃统计记录，需要在锁内调用
+func (file *fileLimiter) flushDropped(path string, tracker *offsetTracker) {
+    if file.dropped == 0 {
+        return
+    }
+    summary := fmt.Sprintf("[log-agent] %s %d records (%d bytes) dropped by rate limit\n",
+        gtime.Datetime(), file.dropped, file.droppedBytes,
+    )
+    pushRecord(path, summary, file.droppedEnd, tracker)
+    file.dropped      = 0
+    file.droppedBytes = 0
+}
+
+// 记录流结束(日志文件被删除或者轮转压缩文件处理完成)，输出尚未输出的丢弃统计后删除限流器
+func removeFileLimiter(path string, tracker *offsetTracker) {
+    if file, ok := fileLimiterMap.Remove(getStreamKey(path, tracker)).(*fileLimiter); ok {
+        file.mu.Lock()
+        file.flushDropped(path, tracker)
+        file.mu.Unlock()
+    }
+}
+
+// 日志文件被删除后，topic下没有其他正在搜集的日志文件时删除topic的限流器
+func removeTopicLimiter(path string) {
+    topic := getTopicFromPath(path)
+    for _, p := range watchedFileSet.Slice() {
+        if p != path && getTopicFromPath(p) == topic {
+            return
+        }
+    }
+    topicLimiterMap.Remove(topic)
+}
+
+// 定时输出日志文件因限流被丢弃的记录数量统计
+func reportDroppedCron() {
+    if droppedMap.Size() == 0 {
+        return
+    }
+    droppedMap.LockFunc(func(m map[string]int) {
+        for path, count := range m {
+            glog.Println("records dropped by rate limit:", path, count)
+            delete(m, path)
+        }
+    })
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// 令牌桶允许1秒的突发流量，超过后返回需要等待的时间，并按照时间补充令牌
+func TestTokenBucketReserve(t *testing.T) {
+    if newTokenBucket(0) != nil {
+        t.Fatal("bucket created for zero rate")
+    }
+    b := newTokenBucket(10)
+    for i := 0; i < 10; i++ {
+        if wait := b.reserve(1); wait != 0 {
+            t.Fatalf("reserve %d waits %v within the burst", i, wait)
+        }
+    }
+    if wait := b.reserve(5); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+        t.Fatalf("reserve 5 over the burst waits %v, want about 500ms", wait)
+    }
+    // 1秒后补充的令牌最多为桶的容量
+    b.last = b.last.Add(-10*time.Second)
+    if wait := b.reserve(10); wait != 0 {
+        t.Fatalf("reserve after refill waits %v", wait)
+    }
+}
+
+// 令牌桶已满时允许超过容量的记录通过，令牌不足时不允许
+func TestTokenBucketAllow(t *testing.T) {
+    b := newTokenBucket(100)
+    if !b.allow(1000) {
+        t.Fatal("full bucket rejects a record larger than its capacity")
+    }
+    b.take(1000)
+    if b.allow(1) {
+        t.Fatal("empty bucket allows a record")
+    }
+}
+
+// 添加测试日志记录，返回最后一条记录的结束位置
+func emitTestRecords(path string, prefix string, count int, end int64) int64 {
+    tracker := getFileTracker(path)
+    for i := 0; i < count; i++ {
+        content := fmt.Sprintf("2018-08-08 13:01:55 INFO %s %d\n", prefix, i)
+        end     += int64(len(content))
+        emitRecord(path, content, end, tracker)
+    }
+    return end
+}
+
+// drop策略下丢弃超过限制的记录，并在下一条允许发送的记录之前插入丢弃统计记录
+func TestLimitRecordDrop(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "limit-drop")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.FileRecordRate = 2
+        rule.LimitPolicy    = LIMIT_POLICY_DROP
+    })
+    end := emitTestRecords(path, "burst", 5, 0)
+    if records := takeTestRecords(queue); len(records) != 2 {
+        t.Fatalf("%d records passed the limit, want 2", len(records))
+    }
+    if count := droppedMap.Get(path); count != 3 {
+        t.Fatalf("%d records counted as dropped, want 3", count)
+    }
+    // 令牌补充后先发送丢弃统计记录
+    limiter := getFileLimiter(getStreamKey(path, getFileTracker(path)), getPathRule(path))
+    limiter.records.last = limiter.records.last.Add(-time.Second)
+    emitTestRecords(path, "after", 1, end)
+    records := takeTestLogRecords(queue)
+    if len(records) != 2 {
+        t.Fatalf("got %d records after refill, want the summary and the record", len(records))
+    }
+    if !strings.Contains(records[0].content, "3 records") || records[0].end != end {
+        t.Fatalf("summary %q at %d, want 3 records at %d", records[0].content, records[0].end, end)
+    }
+    droppedMap.Remove(path)
+}
+
+// block策略下超过限制的记录等待令牌后发送，不丢弃记录
+func TestLimitRecordBlock(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "limit-block")
+    defer cleanup()
+    setTestRule(path, func(rule *pathRule) {
+        rule.FileRecordRate = 20
+        rule.LimitPolicy    = LIMIT_POLICY_BLOCK
+    })
+    start := time.Now()
+    emitTestRecords(path, "block", 25, 0)
+    if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+        t.Fatalf("25 records at 20/s took %v, want at least 200ms", elapsed)
+    }
+    if records := takeTestRecords(queue); len(records) != 25 {
+        t.Fatalf("%d records sent, want 25", len(records))
+    }
+}
+
+// 同一topic下的日志文件共用topic的限流器
+func TestLimitRecordTopicShared(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "limit-topic")
+    defer cleanup()
+    other := filepath.Join(filepath.Dir(path), "other.log")
+    for _, p := range []string{path, other} {
+        setTestRule(p, func(rule *pathRule) {
+            rule.TopicRecordRate = 2
+            rule.LimitPolicy     = LIMIT_POLICY_DROP
+        })
+    }
+    emitTestRecords(path, "first", 2, 0)
+    emitTestRecords(other, "other", 1, 0)
+    if records := takeTestRecords(queue); len(records) != 2 {
+        t.Fatalf("%d records passed the topic limit, want 2", len(records))
+    }
+    if count := droppedMap.Get(other); count != 1 {
+        t.Fatalf("%d records of the other file dropped, want 1", count)
+    }
+    droppedMap.Remove(other)
+    topicLimiterMap.Remove("limit-topic")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/text/gregex"
+    "path/filepath"
+    "strings"
+)
+
+// 日志文件所属的pod信息，从kubelet的pod目录中读取
+type podMeta struct {
+    namespace string // pod所在的namespace
+    pod       string // pod名称
+    container string // 日志卷名称(约定每个容器使用独立的日志卷)
+}
+
+var (
+    // pod信息缓存，键名为kubelet的pod目录及日志卷名称
+    podMetaMap = gmap.NewStringInterfaceMap()
+)
+
+// 获取日志文件所属的pod信息，无法获取的字段为空
+func getPodMeta(path string) *podMeta {
+    match, _ := gregex.MatchString(`^(.+/pods/[^/]+)/volumes/kubernetes\.io~empty\-dir/([^/]+)/`, path)
+    if len(match) < 3 {
+        return &podMeta{}
+    }
+    return podMetaMap.GetOrSetFuncLock(match[1] + ":" + match[2], func() interface{} {
+        return &podMeta {
+            namespace : getPodNamespace(match[1]),
+            pod       : getPodName(match[1]),
+            container : match[2],
+        }
+    }).(*podMeta)
+}
+
+// 从pod的service account卷中读取namespace
+func getPodNamespace(podDir string) string {
+    for _, pattern := range []string{"kubernetes.io~projected/*/namespace", "kubernetes.io~secret/*/namespace"} {
+        if list, err := filepath.Glob(podDir + "/volumes/" + pattern); err == nil && len(list) > 0 {
+            return strings.TrimSpace(gfile.GetContents(list[0]))
+        }
+    }
+    return ""
+}
+
+// 从kubelet为pod生成的hosts文件中读取pod名称(pod的主机名称)
+func getPodName(podDir string) string {
+    lines := strings.Split(strings.TrimSpace(gfile.GetContents(podDir + "/etc-hosts")), "\n")
+    for i := len(lines) - 1; i >= 0; i-- {
+        fields := strings.Fields(lines[i])
+        if len(fields) > 1 && !strings.HasPrefix(fields[0], "#") {
+            return fields[1]
+        }
+    }
+    return ""
+}
+
+// 日志文件被删除后清除pod信息缓存(pod被删除后目录不再存在)
+func removePodMeta(path string) {
+    match, _ := gregex.MatchString(`^(.+/pods/[^/]+)/volumes/kubernetes\.io~empty\-dir/([^/]+)/`, path)
+    if len(match) > 2 && !gfile.Exists(match[1]) {
+        podMetaMap.Remove(match[1] + ":" + match[2])
+    }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "bytes"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gmlock"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gf/g/text/gregex"
+)
+
+// 文件中尚未完整的日志记录，
+// 多行日志(例如异常堆栈)需要等待下一条记录开始或者等待超时后才能确定记录已结束
+type pendingRecord struct {
+    buffer  *bytes.Buffer // 记录内容
+    end     int64         // 记录在文件中的结束位置(即下一条记录的起始offset)
+    updated int64         // 最后一次追加内容的时间(毫秒)
+}
+
+var (
+    // 各日志文件尚未完整的日志记录，操作时需要持有文件的内存锁
+    pendingMap = gmap.NewStringInterfaceMap()
+)
+
+// 获取日志文件的未完整记录对象
+func getPendingRecord(path string) *pendingRecord {
+    return pendingMap.GetOrSetFuncLock(path, func() interface{} {
+        return &pendingRecord{buffer : bytes.NewBuffer(nil)}
+    }).(*pendingRecord)
+}
+
+// 追加日志行到记录中，end为该行在文件中的结束位置
+func (r *pendingRecord) append(content []byte, end int64) {
+    r.buffer.Write(content)
+    r.end     = end
+    r.updated = gtime.Millisecond()
+}
+
+// 取出记录内容及结束位置，并清空记录
+func (r *pendingRecord) take() (string, int64) {
+    content := r.buffer.String()
+    r.buffer.Reset()
+    return content, r.end
+}
+
+/*
+判断是否一条新的日志记录的开始(多行日志数据)，通过正则判断日志行首规则。
+参考内容：
+    标准规范格式：       2018-08-08 13:01:55 DEBUG xxx
+    med3-srv-error.log:  [INFO] 2018-06-20 14:09:20 xxx
+    med-search.log:      [2018-05-24 16:10:20] product.ERROR: xxx
+    quiz-go.log:         time="2018-06-20T14:13:11+08:00" level=info msg="xxx"
+    yilian-shop-crm.log: [2018-06-20 14:10:14]  [2.85ms] xxx
+    nginx.log:           10.26.113.161 - - [2018-06-20T10:59:59+08:00] "POST xxx"
+ */
+func isRecordStart(content []byte) bool {
+    return gregex.IsMatch(`(^\[[A-Za-z]+|^\[\d{4,}|^\d{4,}|^\[\d{1,2}[\-/]\w+[\-/]\d{2,}|^\d+\.\d+\.\d+\.\d+|^time=).+`, content)
+}
+
+// 定时检查超时的未完整记录，超过等待时间没有新的日志行写入则认为记录已完整并放入发送队列
+func flushPendingCron() {
+    for _, path := range pendingMap.Keys() {
+        flushPendingRecord(path, false)
+    }
+}
+
+// 提交日志文件的未完整记录，force为true时不判断等待时间直接提交(例如文件被删除或者重命名)
+func flushPendingRecord(path string, force bool) {
+    record, ok := pendingMap.Get(path).(*pendingRecord)
+    if !ok {
+        return
+    }
+    if force {
+        gmlock.Lock(path)
+    } else if !gmlock.TryLock(path) {
+        // 文件正在搜集中，由搜集流程处理
+        return
+    }
+    defer gmlock.Unlock(path)
+    if record.buffer.Len() == 0 {
+        return
+    }
+    if !force && gtime.Millisecond() - record.updated < multilineTime*1000 {
+        return
+    }
+    msg, end := record.take()
+    emitRecord(path, msg, end, getFileTracker(path))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// 创建测试日志文件所在的临时目录，日志文件路径符合topic解析规则，
+// 并为topic注册测试发送队列(不启动kafka发送协程)，返回日志文件路径、发送队列及清理函数
+func newTestLogFile(t *testing.T, topic string) (string, chan *logRecord, func()) {
+    dir, err := ioutil.TempDir("", "log-agent")
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(dir, "kubernetes.io~empty-dir", "log", topic, "app.log")
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        t.Fatal(err)
+    }
+    queue := make(chan *logRecord, 1024)
+    queueMap.Set(topic, queue)
+    return path, queue, func() {
+        queueMap.Remove(topic)
+        os.RemoveAll(dir)
+    }
+}
+
+// 追加内容到测试日志文件
+func appendTestLog(t *testing.T, path string, content string) {
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    if _, err := file.WriteString(content); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// 取出发送队列中已有的全部记录内容
+func takeTestRecords(queue chan *logRecord) []string {
+    contents := make([]string, 0)
+    for {
+        select {
+        case record := <-queue:
+            contents = append(contents, record.content)
+        default:
+            return contents
+        }
+    }
+}
+
+// 检查发送队列中的记录与期望的内容一致
+func checkTestRecords(t *testing.T, queue chan *logRecord, expected ...string) {
+    contents := takeTestRecords(queue)
+    if len(contents) != len(expected) {
+        t.Fatalf("got %d records %q, want %q", len(contents), contents, expected)
+    }
+    for i := range expected {
+        if contents[i] != expected[i] {
+            t.Fatalf("record %d is %q, want %q", i, contents[i], expected[i])
+        }
+    }
+}
+
+// 多行记录等待下一条记录开始后才发送，行尾没有换行符的内容不会被读取
+func TestCheckLogFileHoldsPendingRecord(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "multiline-hold")
+    defer cleanup()
+    first  := "2018-08-08 13:01:55 INFO first\n"
+    second := "2018-08-08 13:01:56 ERROR second\n\tat Foo.bar(Foo.java:1)\n"
+    appendTestLog(t, path, first + second + "\tat Foo.main(Fo")
+    checkLogFile(path)
+    checkTestRecords(t, queue, first)
+    // 未写完的行不推进读取位置
+    if offset := offsetMapCache.Get(path); offset != len(first + second) {
+        t.Fatalf("offset %d, want %d", offset, len(first + second))
+    }
+    // 堆栈的最后一行写完后仍然属于同一条记录
+    appendTestLog(t, path, "o.java:2)\n")
+    checkLogFile(path)
+    checkTestRecords(t, queue)
+    third := "2018-08-08 13:01:57 INFO third\n"
+    appendTestLog(t, path, third)
+    checkLogFile(path)
+    checkTestRecords(t, queue, second + "\tat Foo.main(Foo.java:2)\n")
+    // 文件被删除或者重命名时直接提交未完整的记录
+    flushPendingRecord(path, true)
+    checkTestRecords(t, queue, third)
+}
+
+// 未完整的记录在等待时间内不发送，超过MULTILINE_TIMEOUT没有新的日志行写入后发送
+func TestFlushPendingRecordTimeout(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "multiline-timeout")
+    defer cleanup()
+    content := "2018-08-08 13:01:55 ERROR failed\n\tat Foo.bar(Foo.java:1)\n"
+    appendTestLog(t, path, content)
+    checkLogFile(path)
+    flushPendingRecord(path, false)
+    checkTestRecords(t, queue)
+    getPendingRecord(path).updated -= multilineTime*1000
+    flushPendingRecord(path, false)
+    checkTestRecords(t, queue, content)
+    // 已发送的记录不会再次发送
+    flushPendingRecord(path, false)
+    checkTestRecords(t, queue)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "crypto/md5"
+    "encoding/json"
+    "fmt"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/container/gset"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gf/g/text/gregex"
+    "io"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// 文件指纹记录。
+// 文件指纹为文件头部内容(压缩文件为解压后的内容)的MD5值，日志文件被重命名或者压缩后指纹保持不变，
+// 因此可以通过指纹找到轮转压缩后的文件在轮转前已提交的offset。
+type fingerprintItem struct {
+    Offset int64 `json:"offset"` // 已提交的内容offset(压缩文件为解压后的offset)
+    Seq    int64 `json:"seq"`    // 压缩文件已确认的消息序列号，从已提交的offset继续处理时沿用
+    Time   int64 `json:"time"`   // 最后更新时间(秒)
+}
+
+// 日志文件当前的指纹
+type fileFingerprint struct {
+    fp   string // 文件指纹
+    size int    // 计算指纹时使用的头部内容大小，不足FINGERPRINT_SIZE时需要重新计算
+}
+
+var (
+    // 文件指纹与offset记录
+    fingerprintMap     = gmap.NewStringInterfaceMap()
+    // 日志文件路径与文件指纹
+    fileFingerprintMap = gmap.NewStringInterfaceMap()
+    // 已处理完成的压缩文件，记录压缩文件的大小及修改时间，没有变化时不再重复解压处理
+    rotatedFileMap     = gmap.NewStringStringMap()
+)
+
+// 计算内容的指纹
+func fingerprint(content []byte) string {
+    return fmt.Sprintf("%x", md5.Sum(content))
+}
+
+// 初始化文件指纹记录
+func initFingerprintMap() {
+    if !gfile.Exists(fpFilePath) {
+        return
+    }
+    items := make(map[string]*fingerprintItem)
+    if err := json.Unmarshal(gfile.GetBinContents(fpFilePath), &items); err != nil {
+        glog.Error(err)
+        return
+    }
+    for fp, item := range items {
+        fingerprintMap.Set(fp, item)
+    }
+}
+
+// 保存文件指纹记录到文件中，并清理过期的记录
+func saveFingerprintMap() {
+    items := make(map[string]*fingerprintItem)
+    fingerprintMap.LockFunc(func(m map[string]interface{}) {
+        now := gtime.Second()
+        for fp, v := range m {
+            if item := v.(*fingerprintItem); now - item.Time > fpExpire {
+                delete(m, fp)
+            } else {
+                items[fp] = item
+            }
+        }
+    })
+    if content, err := json.Marshal(items); err != nil {
+        glog.Error(err)
+    } else {
+        if err := gfile.PutBinContents(fpFilePath, content); err != nil {
+            glog.Error(err)
+        }
+    }
+}
+
+// 获取指纹对应的offset记录，不存在时返回nil
+func getFingerprintItem(fp string) *fingerprintItem {
+    if v := fingerprintMap.Get(fp); v != nil {
+        return v.(*fingerprintItem)
+    }
+    return nil
+}
+
+// 记录指纹对应的已提交offset，保留已确认的消息序列号
+func setFingerprintOffset(fp string, offset int64) {
+    fingerprintMap.LockFunc(func(m map[string]interface{}) {
+        item := &fingerprintItem{Offset : offset, Time : gtime.Second()}
+        if old, ok := m[fp].(*fingerprintItem); ok {
+            item.Seq = old.Seq
+        }
+        m[fp] = item
+    })
+}
+
+// 记录指纹对应的压缩文件已确认的消息序列号，保留已提交的offset
+func setFingerprintSeq(fp string, seq int64) {
+    fingerprintMap.LockFunc(func(m map[string]interface{}) {
+        item := &fingerprintItem{Seq : seq, Time : gtime.Second()}
+        if old, ok := m[fp].(*fingerprintItem); ok {
+            item.Offset = old.Offset
+        }
+        m[fp] = item
+    })
+}
+
+// 更新日志文件的指纹，文件头部内容不足FINGERPRINT_SIZE时指纹会随着文件内容增加而变化，需要重新计算
+func updateFileFingerprint(path string) {
+    old, _ := fileFingerprintMap.Get(path).(*fileFingerprint)
+    if old != nil && old.size >= fpSize {
+        return
+    }
+    head := readFileHead(path, fpSize)
+    if len(head) == 0 {
+        return
+    }
+    fp := fingerprint(head)
+    fileFingerprintMap.Set(path, &fileFingerprint{fp : fp, size : len(head)})
+    if old != nil {
+        if old.fp == fp {
+            return
+        }
+        fingerprintMap.Remove(old.fp)
+    }
+    setFingerprintOffset(fp, int64(offsetMapSave.Get(path)))
+}
+
+// 根据文件指纹生成压缩文件内容的文件标识，压缩文件的消息带有rotated标记，
+// 转储端按照压缩文件单独检测序列号，不与日志文件的文件标识比较
+func getFingerprintEpoch(fp string) int64 {
+    epoch, _ := strconv.ParseInt(fp[ : 15], 16, 64)
+    return epoch
+}
+
+// 获取轮转压缩文件对应的原始日志文件路径，例如：app.log.1.gz, app.log-20181101.gz => app.log
+func getRotatedSourcePath(path string) string {
+    if p, err := gregex.ReplaceString(`(\.log)([\.\-][\w\-]*)?\.gz$`, "$1", path); err == nil && p != path {
+        return p
+    }
+    return strings.TrimSuffix(path, ".gz")
+}
+
+// 检查日志目录下的轮转压缩文件，搜集其中未读取的内容
+func checkRotatedFiles() {
+    list, err := gfile.ScanDir(logPath, "*.gz", true)
+    if err != nil {
+        glog.Error(err)
+        return
+    }
+    exists := gset.NewStringSet()
+    for _, path := range list {
+        // 只搜集empty-dir下的日志
+        if !gregex.IsMatchString(`kubernetes\.io~empty\-dir/log.+`, path) {
+            continue
+        }
+        exists.Add(path)
+        sign := fmt.Sprintf("%d-%d", gfile.Size(path), gfile.MTime(path))
+        if rotatedFileMap.Get(path) == sign {
+            continue
+        }
+        if checkRotatedFile(path) {
+            rotatedFileMap.Set(path, sign)
+        }
+    }
+    // 清理已删除的压缩文件记录
+    for path := range rotatedFileMap.Clone() {
+        if !exists.Contains(path) {
+            rotatedFileMap.Remove(path)
+        }
+    }
+}
+
+// 以流的方式解压轮转压缩文件，将指纹记录的offset之后的内容放入发送队列，返回文件是否处理完成。
+// 压缩文件正在写入或者内容损坏时返回false，下一次检查时重试。
+func checkRotatedFile(path string) bool {
+    file, err := os.Open(path)
+    if err != nil {
+        glog.Error(err)
+        return false
+    }
+    defer file.Close()
+    reader, err := gzip.NewReader(file)
+    if err != nil {
+        glog.Error(path, err)
+        return false
+    }
+    defer reader.Close()
+    lines := bufio.NewReaderSize(reader, fpSize + 4096)
+    head, err := lines.Peek(fpSize)
+    if err != nil && err != io.EOF {
+        glog.Error(path, err)
+        return false
+    }
+    if len(head) == 0 {
+        return true
+    }
+    fp     := fingerprint(head)
+    offset := int64(0)
+    seq    := int64(0)
+    if item := getFingerprintItem(fp); item != nil {
+        offset = item.Offset
+        // 与日志文件相同，只有从上次提交的位置继续处理时才沿用之前的序列号
+        if offset > 0 {
+            seq = item.Seq
+        }
+    } else if gtime.Second() - gfile.MTime(path) > rotatedMaxAge {
+        glog.Debug("ignore rotated file without fingerprint:", path)
+        return true
+    }
+    if offset > 0 {
+        if _, err := io.CopyN(ioutil.Discard, lines, offset); err != nil {
+            if err == io.EOF {
+                return true
+            }
+            glog.Error(path, err)
+            return false
+        }
+    }
+    srcPath := getRotatedSourcePath(path)
+    rule    := getPathRule(srcPath)
+    name    := strings.ToLower(rule.Encoding)
+    if name == ENCODING_AUTO {
+        name = detectEncoding(head)
+    }
+    glog.Debugfln("check rotated file: %s, source: %s, offset: %d", path, srcPath, offset)
+    record  := &pendingRecord{buffer : bytes.NewBuffer(nil)}
+    tracker := newOffsetTracker(getFingerprintEpoch(fp), seq, offset, func(offset int64) {
+        setFingerprintOffset(fp, offset)
+    })
+    tracker.rotated = true
+    tracker.fp      = fp
+    // 压缩文件处理结束后输出该记录流的重复及丢弃统计，并删除对应的状态
+    defer removeFileLimiter(srcPath, tracker)
+    defer removeDedupState(srcPath, tracker)
+    pos := offset
+    for {
+        content, err := readRotatedLine(lines, name)
+        if len(content) > 0 {
+            first   := pos == 0
+            pos     += int64(len(content))
+            content  = decodeLogLine(srcPath, content, name, rule, first)
+            if record.buffer.Len() > 0 && isRecordStart(content) {
+                msg, end := record.take()
+                emitRecord(srcPath, msg, end, tracker)
+            }
+            record.append(content, pos)
+        }
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            glog.Error(path, err)
+            return false
+        }
+    }
+    // 压缩文件的内容已经完整，最后一条记录直接提交
+    if record.buffer.Len() > 0 {
+        msg, end := record.take()
+        emitRecord(srcPath, msg, end, tracker)
+    }
+    return true
+}
+
+// 从解压流中读取一行内容，UTF-16编码的换行符为两个字节
+func readRotatedLine(reader *bufio.Reader, name string) ([]byte, error) {
+    if name != ENCODING_UTF16LE && name != ENCODING_UTF16BE {
+        return reader.ReadBytes('\n')
+    }
+    buffer := bytes.NewBuffer(nil)
+    unit   := make([]byte, 2)
+    for {
+        n, err := io.ReadFull(reader, unit)
+        buffer.Write(unit[ : n])
+        if err != nil {
+            if err == io.ErrUnexpectedEOF {
+                err = io.EOF
+            }
+            return buffer.Bytes(), err
+        }
+        if (name == ENCODING_UTF16LE && unit[0] == '\n' && unit[1] == 0) || (name == ENCODING_UTF16BE && unit[0] == 0 && unit[1] == '\n') {
+            return buffer.Bytes(), nil
+        }
+    }
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "compress/gzip"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// 将内容写入轮转压缩文件
+func writeTestGzip(t *testing.T, path string, content string) {
+    file, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    writer := gzip.NewWriter(file)
+    if _, err := writer.Write([]byte(content)); err != nil {
+        t.Fatal(err)
+    }
+    if err := writer.Close(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// 取出发送队列中已有的全部记录
+func takeTestLogRecords(queue chan *logRecord) []*logRecord {
+    records := make([]*logRecord, 0)
+    for {
+        select {
+        case record := <-queue:
+            records = append(records, record)
+        default:
+            return records
+        }
+    }
+}
+
+// 确认发送的记录，模拟kafka确认消息
+func ackTestRecord(record *logRecord) {
+    seq := record.tracker.nextSeq()
+    record.tracker.ackSeq(seq)
+    record.tracker.ack(record.element)
+}
+
+func TestGetRotatedSourcePath(t *testing.T) {
+    cases := map[string]string {
+        "/log/app.log.1.gz"        : "/log/app.log",
+        "/log/app.log-20181101.gz" : "/log/app.log",
+        "/log/app.log.gz"          : "/log/app.log",
+        "/log/app-20181101.gz"     : "/log/app-20181101",
+    }
+    for path, expected := range cases {
+        if src := getRotatedSourcePath(path); src != expected {
+            t.Fatalf("source of %s is %s, want %s", path, src, expected)
+        }
+    }
+}
+
+// 日志文件被轮转压缩后，从指纹记录的已提交offset继续搜集压缩文件中未确认的内容，
+// 重启后从压缩文件已提交的offset继续处理，并沿用之前的序列号
+func TestCheckRotatedFileResumesFromFingerprint(t *testing.T) {
+    path, queue, cleanup := newTestLogFile(t, "rotated-gzip")
+    defer cleanup()
+    defer func(enabled bool, fpPath string) {
+        rotatedGzip = enabled
+        fpFilePath  = fpPath
+    }(rotatedGzip, fpFilePath)
+    rotatedGzip = true
+    fpFilePath  = filepath.Join(filepath.Dir(path), "fingerprints.json")
+    lines := []string {
+        "2018-08-08 13:01:55 INFO first\n",
+        "2018-08-08 13:01:56 INFO second\n",
+        "2018-08-08 13:01:57 INFO third\n",
+    }
+    content := lines[0] + lines[1] + lines[2]
+    appendTestLog(t, path, content)
+    checkLogFile(path)
+    records := takeTestLogRecords(queue)
+    if len(records) != 2 {
+        t.Fatalf("got %d records from the log file, want 2", len(records))
+    }
+    // 只有第一条记录被kafka确认后文件就被轮转压缩
+    ackTestRecord(records[0])
+    removeFileTracker(path)
+    gzPath := path + ".1.gz"
+    writeTestGzip(t, gzPath, content)
+    if err := os.Remove(path); err != nil {
+        t.Fatal(err)
+    }
+    if !checkRotatedFile(gzPath) {
+        t.Fatal("rotated file not completed")
+    }
+    records = takeTestLogRecords(queue)
+    if len(records) != 2 || records[0].content != lines[1] || records[1].content != lines[2] {
+        t.Fatalf("got %d records from the rotated file, want the last 2", len(records))
+    }
+    if records[0].path != path || !records[0].tracker.rotated {
+        t.Fatalf("rotated record path %s, rotated %v", records[0].path, records[0].tracker.rotated)
+    }
+    epoch := records[0].tracker.epoch
+    ackTestRecord(records[0])
+    // 重启后从文件加载指纹记录
+    saveFingerprintMap()
+    fingerprintMap.Clear()
+    initFingerprintMap()
+    if !checkRotatedFile(gzPath) {
+        t.Fatal("rotated file not completed after restart")
+    }
+    records = takeTestLogRecords(queue)
+    if len(records) != 1 || records[0].content != lines[2] {
+        t.Fatalf("got %d records after restart, want the last one", len(records))
+    }
+    if tracker := records[0].tracker; tracker.epoch != epoch || tracker.seq != 1 {
+        t.Fatalf("resumed with epoch %d seq %d, want epoch %d seq 1", tracker.epoch, tracker.seq, epoch)
+    }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "encoding/json"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/text/gregex"
+)
+
+// 按照日志文件路径匹配的搜集规则，
+// 规则文件内容为JSON数组，按照顺序匹配，使用第一条匹配的规则，没有匹配的规则时使用默认规则(环境变量配置)。
+// 规则中未配置的字段使用默认规则的值。
+type pathRule struct {
+    Pattern         string `json:"pattern"`         // 日志文件路径匹配正则，为空时匹配所有文件
+    Encoding        string `json:"encoding"`        // 源文件字符编码，例如：utf-8, gbk, gb18030, utf-16le, utf-16be, auto(自动识别)
+    Crlf            bool   `json:"crlf"`            // 是否将CRLF行尾转换为LF
+    FileByteRate    int64  `json:"fileByteRate"`    // (byte/秒)单个文件的搜集速率限制，0表示不限制
+    FileRecordRate  int64  `json:"fileRecordRate"`  // (条/秒)单个文件的搜集速率限制，0表示不限制
+    TopicByteRate   int64  `json:"topicByteRate"`   // (byte/秒)单个topic的搜集速率限制，0表示不限制，以创建topic限流器时匹配的规则为准
+    TopicRecordRate int64  `json:"topicRecordRate"` // (条/秒)单个topic的搜集速率限制，0表示不限制
+    LimitPolicy     string `json:"limitPolicy"`     // 超过速率限制时的处理策略：block(阻塞文件搜集), drop(丢弃并记录统计)
+    DedupWindow     int64  `json:"dedupWindow"`     // (秒)连续重复日志记录的合并时间窗口，0表示不合并
+    DedupMaxCount   int    `json:"dedupMaxCount"`   // 单次合并的最大重复次数，达到后立即输出重复统计，0表示不限制
+    DedupIgnoreTime bool   `json:"dedupIgnoreTime"` // 合并时是否忽略记录中的时间，使只有时间不同的记录也被视为重复
+}
+
+var (
+    // 从规则文件加载的搜集规则
+    pathRules   = make([]*pathRule, 0)
+    // 日志文件路径与匹配规则的缓存
+    pathRuleMap = gmap.NewStringInterfaceMap()
+)
+
+// 默认搜集规则
+func newDefaultRule() *pathRule {
+    return &pathRule {
+        Encoding        : sourceEncoding,
+        Crlf            : normalizeCrlf,
+        FileByteRate    : fileByteRate,
+        FileRecordRate  : fileRecordRate,
+        TopicByteRate   : topicByteRate,
+        TopicRecordRate : topicRecordRate,
+        LimitPolicy     : limitPolicy,
+        DedupWindow     : dedupWindow,
+        DedupMaxCount   : dedupMaxCount,
+        DedupIgnoreTime : dedupIgnoreTime,
+    }
+}
+
+// 初始化搜集规则
+func initPathRules() {
+    if !gfile.Exists(rulesFilePath) {
+        return
+    }
+    items := make([]json.RawMessage, 0)
+    if err := json.Unmarshal(gfile.GetBinContents(rulesFilePath), &items); err != nil {
+        glog.Error(err)
+        return
+    }
+    for _, item := range items {
+        rule := newDefaultRule()
+        if err := json.Unmarshal(item, rule); err != nil {
+            glog.Error(err)
+            continue
+        }
+        glog.Debugfln("init path rule: %s", string(item))
+        pathRules = append(pathRules, rule)
+    }
+}
+
+// 获取日志文件对应的搜集规则
+func getPathRule(path string) *pathRule {
+    return pathRuleMap.GetOrSetFuncLock(path, func() interface{} {
+        for _, rule := range pathRules {
+            if rule.Pattern == "" || gregex.IsMatchString(rule.Pattern, path) {
+                return rule
+            }
+        }
+        return newDefaultRule()
+    }).(*pathRule)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+    "container/list"
+    "encoding/json"
+    "fmt"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "sync"
+)
+
+// offset提交记录中的一项
+type trackItem struct {
+    end   int64 // 日志记录在源文件中的结束位置
+    acked bool  // 是否已被kafka确认
+}
+
+// 日志源文件(日志文件或者轮转压缩文件)的offset提交记录。
+// 记录按照读取顺序排列，只有之前的记录都被kafka确认后才推进提交的offset，
+// 保证持久化的offset之前的内容都已经真实写入kafka。
+// 同时为源文件的每条消息分配递增的序列号，以便转储端检测消息的丢失、重复及乱序。
+type offsetTracker struct {
+    mu      sync.Mutex
+    path    string             // 日志文件路径，不为空时持久化保存文件标识及序列号
+    epoch   int64              // 文件标识
+    rotated bool               // 是否为轮转压缩文件
+    fp      string             // 轮转压缩文件的指纹，不为空时序列号保存到指纹记录中
+    seq     int64              // 最后分配的消息序列号
+    acked   int64              // 最后确认的消息序列号
+    last    int64              // 最后添加的记录的结束位置，即下一条记录的起始位置
+    items   *list.List         // 已读取但未全部确认的记录
+    commit  func(offset int64) // 推进offset时的回调
+}
+
+// 日志文件标识及已确认的消息序列号
+type fileSequence struct {
+    Epoch int64 `json:"epoch"`
+    Seq   int64 `json:"seq"`
+}
+
+var (
+    // 日志文件的offset提交记录
+    trackerMap  = gmap.NewStringInterfaceMap()
+    // 日志文件标识及已确认的消息序列号，用于持久化保存
+    sequenceMap = gmap.NewStringInterfaceMap()
+)
+
+// 创建offset提交记录，start为源文件开始读取的位置
+func newOffsetTracker(epoch int64, seq int64, start int64, commit func(offset int64)) *offsetTracker {
+    return &offsetTracker {
+        epoch  : epoch,
+        seq    : seq,
+        acked  : seq,
+        last   : start,
+        items  : list.New(),
+        commit : commit,
+    }
+}
+
+// 添加已读取的日志记录，返回记录在提交记录中的位置及记录的起始位置
+func (t *offsetTracker) add(end int64) (*list.Element, int64) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    start := t.last
+    if end > t.last {
+        t.last = end
+    }
+    return t.items.PushBack(&trackItem{end : end}), start
+}
+
+// 确认日志记录，并推进已确认的连续记录的offset
+func (t *offsetTracker) ack(e *list.Element) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    e.Value.(*trackItem).acked = true
+    offset := int64(-1)
+    for front := t.items.Front(); front != nil && front.Value.(*trackItem).acked; front = t.items.Front() {
+        if end := front.Value.(*trackItem).end; end > offset {
+            offset = end
+        }
+        t.items.Remove(front)
+    }
+    if offset >= 0 {
+        t.commit(offset)
+    }
+}
+
+// 分配下一条消息的序列号
+func (t *offsetTracker) nextSeq() int64 {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.seq++
+    return t.seq
+}
+
+// 确认消息序列号
+func (t *offsetTracker) ackSeq(seq int64) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if seq <= t.acked {
+        return
+    }
+    t.acked = seq
+    if t.path != "" {
+        sequenceMap.Set(t.path, &fileSequence{Epoch : t.epoch, Seq : seq})
+    }
+    if t.fp != "" {
+        setFingerprintSeq(t.fp, seq)
+    }
+}
+
+// 替换推进offset时的回调，并不再保存文件的序列号
+func (t *offsetTracker) detach(commit func(offset int64)) {
+    t.mu.Lock()
+    t.path   = ""
+    t.commit = commit
+    t.mu.Unlock()
+}
+
+// 获取日志文件的offset提交记录。
+// 从上次提交的位置继续搜集时沿用之前的文件标识及序列号，从头开始搜集时视为新的文件。
+func getFileTracker(path string) *offsetTracker {
+    return trackerMap.GetOrSetFuncLock(path, func() interface{} {
+        start := int64(offsetMapCache.Get(path))
+        epoch := gtime.Nanosecond()
+        seq   := int64(0)
+        if v, ok := sequenceMap.Get(path).(*fileSequence); ok && start > 0 {
+            epoch = v.Epoch
+            seq   = v.Seq
+        } else {
+            sequenceMap.Set(path, &fileSequence{Epoch : epoch})
+        }
+        tracker := newOffsetTracker(epoch, seq, start, func(offset int64) {
+            saveFileOffset(path, offset)
+        })
+        tracker.path = path
+        return tracker
+    }).(*offsetTracker)
+}
+
+// 日志记录流的标识，日志文件与其轮转压缩文件使用相同的路径但是文件标识不同，
+// 重复记录合并及限流的状态按照记录流分别保存
+func getStreamKey(path string, tracker *offsetTracker) string {
+    return fmt.Sprintf("%s@%d", path, tracker.epoch)
+}
+
+// 日志文件被删除或者重命名后，未确认记录的offset只记录到原文件的指纹中(用于轮转压缩文件的搜集)，
+// 防止覆盖同名新文件的offset
+func removeFileTracker(path string) {
+    v := trackerMap.Remove(path)
+    if v == nil {
+        return
+    }
+    fp := ""
+    if f, ok := fileFingerprintMap.Get(path).(*fileFingerprint); ok {
+        fp = f.fp
+    }
+    v.(*offsetTracker).detach(func(offset int64) {
+        if fp != "" {
+            setFingerprintOffset(fp, offset)
+        }
+    })
+}
+
+// 初始化日志文件标识及序列号记录
+func initSequenceMap() {
+    if !gfile.Exists(seqFilePath) {
+        return
+    }
+    items := make(map[string]*fileSequence)
+    if err := json.Unmarshal(gfile.GetBinContents(seqFilePath), &items); err != nil {
+        glog.Error(err)
+        return
+    }
+    for path, item := range items {
+        sequenceMap.Set(path, item)
+    }
+}
+
+// 保存日志文件标识及序列号记录到文件中
+func saveSequenceMap() {
+    if sequenceMap.Size() == 0 {
+        return
+    }
+    if content, err := json.Marshal(sequenceMap.Clone()); err != nil {
+        glog.Error(err)
+    } else {
+        if err := gfile.PutBinContents(seqFilePath, content); err != nil {
+            glog.Error(err)
+        }
+    }
+}
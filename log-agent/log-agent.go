@@ -8,7 +8,6 @@
 package main
 
 import (
-    "bytes"
     "github.com/gogf/gf/g/container/gmap"
     "github.com/gogf/gf/g/container/gset"
     "github.com/gogf/gf/g/encoding/gjson"
@@ -21,6 +20,7 @@ import (
     "github.com/gogf/gf/g/os/gmlock"
     "github.com/gogf/gf/g/util/gconv"
     "github.com/gogf/gf/g/text/gregex"
+    "k8s-log/internal/kafkaauth"
     "os"
     "time"
 )
@@ -34,6 +34,29 @@ const (
     CLEAN_MAX_SIZE    = "1073741824"                 // 默认值，(byte)日志文件最大限制，当清理时执行规则处理(默认1GB)；
     SEND_MAX_SIZE     = "10240"                      // 默认值，(byte)每条消息发送时的最大值(包大小限制, 默认10KB)
                                                      // 注意：通过性能测试，kafka在消息为10K时吞吐量达到最大，更大的消息会降低吞吐量，在设计集群的容量时，尤其要考虑这点
+    MULTILINE_TIMEOUT = "3"                          // 默认值，(秒)多行日志记录的等待时间，超过该时间没有新的日志行写入则认为记录已完整
+    RULES_FILE_PATH   = "/var/lib/kubelet/log-agent.rules"   // 默认值，按路径匹配的搜集规则文件(JSON数组)，不存在时所有文件使用默认规则
+    SOURCE_ENCODING   = "utf-8"                      // 默认值，日志文件的字符编码，设置为auto时自动识别，搜集时统一转换为UTF-8
+    NORMALIZE_CRLF    = "false"                      // 默认值，是否将CRLF行尾转换为LF
+    ROTATED_GZIP      = "false"                      // 默认值，是否搜集被轮转压缩的日志文件(例如: app.log.1.gz)中未读取的内容
+    ROTATED_MAX_AGE   = "3600"                       // 默认值，(秒)未记录指纹的压缩文件，超过该时间没有更新则不再搜集(防止首次启动时重复搜集历史文件)
+    FINGERPRINT_PATH  = "/var/lib/kubelet/log-agent.fingerprints" // 默认值，文件指纹与offset记录，用于识别轮转压缩后的文件
+    FINGERPRINT_SIZE  = "1024"                       // 默认值，(byte)计算文件指纹时使用的文件头部内容大小
+    FINGERPRINT_TTL   = "604800"                     // 默认值，(秒)文件指纹记录的保留时间(默认7天)
+    SEQUENCE_PATH     = "/var/lib/kubelet/log-agent.sequences"    // 默认值，日志文件标识及已确认的消息序列号记录，重启后继续递增序列号
+    QUEUE_SIZE        = "10000"                      // 默认值，每个topic发送队列的日志记录数量限制，队列满时阻塞文件搜集
+    BATCH_BYTES       = "1048576"                    // 默认值，(byte)批量发送的日志内容大小(默认1MB)
+    LINGER_MS         = "100"                        // 默认值，(毫秒)批量发送的最长等待时间
+    MAX_IN_FLIGHT     = "5"                          // 默认值，每个topic已发送未确认的批次数量限制
+    KAFKA_ACKS        = "all"                        // 默认值，kafka消息确认级别：all(所有副本确认), 1(leader确认), 0(不等待确认)
+    FILE_BYTE_RATE    = "0"                          // 默认值，(byte/秒)单个文件的搜集速率限制，0表示不限制
+    FILE_RECORD_RATE  = "0"                          // 默认值，(条/秒)单个文件的搜集速率限制，0表示不限制
+    TOPIC_BYTE_RATE   = "0"                          // 默认值，(byte/秒)单个topic的搜集速率限制，0表示不限制
+    TOPIC_RECORD_RATE = "0"                          // 默认值，(条/秒)单个topic的搜集速率限制，0表示不限制
+    LIMIT_POLICY      = "block"                      // 默认值，超过速率限制时的处理策略：block(阻塞文件搜集), drop(丢弃并记录统计)
+    DEDUP_WINDOW      = "0"                          // 默认值，(秒)连续重复日志记录的合并时间窗口，窗口内的重复记录合并为一条记录及重复统计，0表示不合并
+    DEDUP_MAX_COUNT   = "0"                          // 默认值，单次合并的最大重复次数，达到后立即输出重复统计，0表示不限制
+    DEDUP_IGNORE_TIME = "false"                      // 默认值，合并重复记录时是否忽略记录中的时间，默认只合并内容完全相同的记录
     DEBUG             = "true"                       // 默认值，是否打开调试信息
 )
 
@@ -47,10 +70,19 @@ type Package struct {
 
 // kafka消息数据结构
 type Message struct {
-    Path string   `json:"path"` // 日志文件路径
-    Msgs []string `json:"msgs"` // 日志内容(多条)
-    Time string   `json:"time"` // 发送时间(客户端搜集时间)
-    Host string   `json:"host"` // 节点主机名称
+    Path      string   `json:"path"`                // 日志文件路径
+    Msgs      []string `json:"msgs"`                // 日志内容(多条)
+    Time      string   `json:"time"`                // 发送时间(客户端搜集时间)
+    Host      string   `json:"host"`                // 节点主机名称
+    Namespace string   `json:"namespace,omitempty"` // pod所在的namespace
+    Pod       string   `json:"pod,omitempty"`       // pod名称
+    Container string   `json:"container,omitempty"` // 日志卷名称
+    Epoch     int64    `json:"epoch"`               // 文件标识，文件被重新创建(轮转、清空)后标识改变，序列号及字节范围重新计算
+    Seq       int64    `json:"seq"`                 // 消息在文件中的序列号(同一文件标识下单调递增)
+    Start     int64    `json:"start"`               // 消息内容在文件中的起始位置
+    End       int64    `json:"end"`                 // 消息内容在文件中的结束位置(不包含)，即[start, end)
+    Ends      []int64  `json:"ends"`                // 每条日志记录在文件中的结束位置，转储端用于过滤重发的日志记录
+    Rotated   bool     `json:"rotated,omitempty"`   // 内容是否来自轮转压缩文件，压缩文件的文件标识及序列号独立于日志文件
 }
 
 var (
@@ -68,9 +100,36 @@ var (
     cleanMinSize   = gconv.Int64(genv.Get("CLEAN_MIN_SIZE", CLEAN_MIN_SIZE))
     cleanMaxSize   = gconv.Int64(genv.Get("CLEAN_MAX_SIZE", CLEAN_MAX_SIZE))
     sendMaxSize    = gconv.Int(genv.Get("SEND_MAX_SIZE", SEND_MAX_SIZE))
+    multilineTime  = gconv.Int64(genv.Get("MULTILINE_TIMEOUT", MULTILINE_TIMEOUT))
+    rulesFilePath  = genv.Get("RULES_FILE_PATH", RULES_FILE_PATH)
+    sourceEncoding = genv.Get("SOURCE_ENCODING", SOURCE_ENCODING)
+    normalizeCrlf  = gconv.Bool(genv.Get("NORMALIZE_CRLF", NORMALIZE_CRLF))
+    rotatedGzip    = gconv.Bool(genv.Get("ROTATED_GZIP", ROTATED_GZIP))
+    rotatedMaxAge  = gconv.Int64(genv.Get("ROTATED_MAX_AGE", ROTATED_MAX_AGE))
+    fpFilePath     = genv.Get("FINGERPRINT_PATH", FINGERPRINT_PATH)
+    fpSize         = gconv.Int(genv.Get("FINGERPRINT_SIZE", FINGERPRINT_SIZE))
+    fpExpire       = gconv.Int64(genv.Get("FINGERPRINT_TTL", FINGERPRINT_TTL))
+    seqFilePath    = genv.Get("SEQUENCE_PATH", SEQUENCE_PATH)
     dryrun         = gconv.Bool(gcmd.Option.Get("dryrun", "0"))
     debug          = gconv.Bool(genv.Get("DEBUG", DEBUG))
+    queueSize      = gconv.Int(genv.Get("QUEUE_SIZE", QUEUE_SIZE))
+    batchBytes     = gconv.Int(genv.Get("BATCH_BYTES", BATCH_BYTES))
+    lingerTime     = gconv.Int(genv.Get("LINGER_MS", LINGER_MS))
+    maxInFlight    = gconv.Int(genv.Get("MAX_IN_FLIGHT", MAX_IN_FLIGHT))
+    kafkaAcks      = genv.Get("KAFKA_ACKS", KAFKA_ACKS)
+    limitPolicy    = genv.Get("LIMIT_POLICY", LIMIT_POLICY)
+    dedupWindow    = gconv.Int64(genv.Get("DEDUP_WINDOW", DEDUP_WINDOW))
+    dedupMaxCount  = gconv.Int(genv.Get("DEDUP_MAX_COUNT", DEDUP_MAX_COUNT))
     kafkaAddr      = genv.Get("KAFKA_ADDR")
+    // 默认的搜集速率限制，可以通过搜集规则按照路径单独配置
+    fileByteRate    = gconv.Int64(genv.Get("FILE_BYTE_RATE", FILE_BYTE_RATE))
+    fileRecordRate  = gconv.Int64(genv.Get("FILE_RECORD_RATE", FILE_RECORD_RATE))
+    topicByteRate   = gconv.Int64(genv.Get("TOPIC_BYTE_RATE", TOPIC_BYTE_RATE))
+    topicRecordRate = gconv.Int64(genv.Get("TOPIC_RECORD_RATE", TOPIC_RECORD_RATE))
+    // 默认只合并内容完全相同的重复记录，可以通过搜集规则按照路径设置忽略记录中的时间
+    dedupIgnoreTime = gconv.Bool(genv.Get("DEDUP_IGNORE_TIME", DEDUP_IGNORE_TIME))
+    // kafka安全设置，SASL用户名及密码通过KAFKA_SASL_USER(_FILE)及KAFKA_SASL_PASSWORD(_FILE)读取
+    kafkaAuth       = kafkaauth.FromEnv()
 )
 
 func main() {
@@ -79,9 +138,24 @@ func main() {
     // 初始化偏移量信息
     initOffsetMap()
 
+    // 初始化搜集规则
+    initPathRules()
+
     // 每秒保存偏移量记录
     gcron.Add("* * * * * *", saveOffsetCron)
 
+    // 每秒检查超时的多行日志记录
+    gcron.Add("* * * * * *", flushPendingCron)
+
+    // 每秒检查合并时间窗口结束的重复日志记录
+    gcron.Add("* * * * * *", flushDedupCron)
+
+    // 每分钟输出无效字节替换统计
+    gcron.Add("0 * * * * *", reportInvalidByteCron)
+
+    // 每分钟输出限流丢弃统计
+    gcron.Add("0 * * * * *", reportDroppedCron)
+
     // 每个小时执行清理工作
     gcron.Add("0 0 * * * *", cleanLogCron)
 
@@ -100,6 +174,18 @@ func main() {
                         //glog.Debugfln(event.String())
                         // 如果日志文件被删除或者重命名，移除监听及记录，以便重新添加监听
                         if event.IsRename() || event.IsRemove() {
+                            // 文件不会再有新的内容写入，未完整的记录直接提交
+                            flushPendingRecord(event.Path, true)
+                            if v := trackerMap.Get(event.Path); v != nil {
+                                removeDedupState(event.Path, v.(*offsetTracker))
+                                removeFileLimiter(event.Path, v.(*offsetTracker))
+                            }
+                            removeTopicLimiter(event.Path)
+                            pendingMap.Remove(event.Path)
+                            fileEncodingMap.Remove(event.Path)
+                            removeFileTracker(event.Path)
+                            fileFingerprintMap.Remove(event.Path)
+                            removePodMeta(event.Path)
                             watchedFileSet.Remove(event.Path)
                             offsetMapCache.Remove(event.Path)
                             gfsnotify.Remove(event.Path)
@@ -114,18 +200,27 @@ func main() {
         } else {
             glog.Error(err)
         }
+        // 搜集轮转压缩文件中未读取的内容
+        if rotatedGzip {
+            checkRotatedFiles()
+        }
         time.Sleep(scanInterval*time.Second)
     }
 }
 
 // 初始化偏移量信息
 func initOffsetMap() {
+    if rotatedGzip {
+        initFingerprintMap()
+    }
+    initSequenceMap()
     if gfile.Exists(offsetFilePath) {
         content := gfile.GetBinContents(offsetFilePath)
         if j, err := gjson.DecodeToJson(content); err == nil {
             for k, v := range j.ToMap(){
                 glog.Debug("init file offset:", k, gconv.Int(v))
                 offsetMapCache.Set(k, gconv.Int(v))
+                offsetMapSave.Set(k, gconv.Int(v))
             }
         } else {
             glog.Error(err)
@@ -133,7 +228,8 @@ func initOffsetMap() {
     }
 }
 
-// 检查文件变化，并将变化的内容提交到kafka
+// 检查文件变化，并将变化的内容放入kafka发送队列
+// 最后一条日志记录会缓存到文件的未完整记录中，等待下一条记录开始或者超时后再提交
 func checkLogFile(path string) {
     // 使用内存锁保证同一时刻只有一个goroutine在执行同一文件的日志搜集
     if gmlock.TryLock(path) {
@@ -142,54 +238,51 @@ func checkLogFile(path string) {
         glog.Debug("mlock:", path)
         return
     }
-    msgs    := make([]string, 0)
-    buffer  := bytes.NewBuffer(nil)
-    msgSize := 0
-    offset  := int64(0)
+    // 文件被截断(例如被清理)后作为新的文件从头开始搜集
+    if gfile.Size(path) < int64(offsetMapCache.Get(path)) {
+        resetTruncatedFile(path)
+    }
+    rule    := getPathRule(path)
+    name    := getFileEncoding(path, rule)
+    record  := getPendingRecord(path)
+    tracker := getFileTracker(path)
     for {
-        content, pos := gfile.GetBinContentsTilCharByPath(path, '\n', int64(offsetMapCache.Get(path)))
-        if pos > 0 {
-            offset = pos
-            if buffer.Len() > 0 {
-                /*
-                判断是否多行日志数据，通过正则判断日志行首规则。
-                参考内容：
-                    标准规范格式：       2018-08-08 13:01:55 DEBUG xxx
-                    med3-srv-error.log:  [INFO] 2018-06-20 14:09:20 xxx
-                    med-search.log:      [2018-05-24 16:10:20] product.ERROR: xxx
-                    quiz-go.log:         time="2018-06-20T14:13:11+08:00" level=info msg="xxx"
-                    yilian-shop-crm.log: [2018-06-20 14:10:14]  [2.85ms] xxx
-                    nginx.log:           10.26.113.161 - - [2018-06-20T10:59:59+08:00] "POST xxx"
-                 */
-                if !gregex.IsMatch(`(^\[[A-Za-z]+|^\[\d{4,}|^\d{4,}|^\[\d{1,2}[\-/]\w+[\-/]\d{2,}|^\d+\.\d+\.\d+\.\d+|^time=).+`, content) {
-                    buffer.Write(content)
-                } else {
-                    if msgSize  + len(content) > sendMaxSize {
-                        sendToKafka(path, msgs, offset)
-                        msgs    = make([]string, 0)
-                        msgSize = 0
-                    }
-                    msgs     = append(msgs, buffer.String())
-                    msgSize += buffer.Len()
-                    buffer.Reset()
-                    buffer.Write(content)
-                }
-            } else {
-                buffer.Write(content)
-            }
-            offsetMapCache.Set(path, int(offset) + 1)
-        } else {
-            if buffer.Len() > 0 {
-                msgs     = append(msgs, buffer.String())
-                msgSize += buffer.Len()
-                buffer.Reset()
-            }
+        // 只读取以换行符结尾的完整日志行，行尾尚未写完的内容等待下一次检查时再读取
+        start        := int64(offsetMapCache.Get(path))
+        content, pos := readLogLine(path, start, name)
+        if pos < 0 {
             break
         }
+        // 统一转换为UTF-8编码后再进行多行日志的判断
+        content = decodeLogLine(path, content, name, rule, start == 0)
+        // 新的日志记录开始，说明之前缓存的记录已经完整，放入发送队列
+        if record.buffer.Len() > 0 && isRecordStart(content) {
+            msg, end := record.take()
+            emitRecord(path, msg, end, tracker)
+        }
+        record.append(content, pos + 1)
+        offsetMapCache.Set(path, int(pos) + 1)
     }
-    // 跳出循环后如果有数据则再次执行发送
-    if len(msgs) > 0 {
-        sendToKafka(path, msgs, offset)
+    // 更新文件指纹，用于文件被轮转压缩后继续搜集未读取的内容
+    if rotatedGzip {
+        updateFileFingerprint(path)
     }
 }
 
+// 重置被截断的日志文件的搜集状态，需要在持有文件内存锁时调用。
+// 截断前未完整的记录直接提交，之后的内容使用新的文件标识及序列号，并重新识别字符编码及BOM。
+func resetTruncatedFile(path string) {
+    glog.Println("log file truncated:", path)
+    if record, ok := pendingMap.Get(path).(*pendingRecord); ok && record.buffer.Len() > 0 {
+        msg, end := record.take()
+        emitRecord(path, msg, end, getFileTracker(path))
+    }
+    if v := trackerMap.Get(path); v != nil {
+        removeDedupState(path, v.(*offsetTracker))
+        removeFileLimiter(path, v.(*offsetTracker))
+    }
+    fileEncodingMap.Remove(path)
+    removeFileTracker(path)
+    fileFingerprintMap.Remove(path)
+    offsetMapCache.Set(path, 0)
+}
@@ -1,4 +1,6 @@
 // 定时将30天之前/或者大小超过指定限制的数据进行压缩归档并删除(原始日志文件保留30天)，时间可通过环境变量配置。
+// log-dumper按照时间或者大小切分输出文件时(SEGMENT_ONLY=true)，只处理带有完成标记(.done)或者超过过期时间没有更新的分段文件，不再对文件进行重命名。
+// log-dumper的状态目录(__dumper_开头，例如offsets、字节范围窗口、审计日志及死信)不做归档处理。
 
 package main
 
@@ -12,20 +14,25 @@ import (
     "github.com/gogf/gf/g/os/gtime"
     "github.com/gogf/gf/g/util/gconv"
     "os"
+    "strings"
 )
 
 const (
-    LOG_PATH  = "/var/log/medlinker" // 日志目录
-    EXPIRE    = "30"                 // 过期时间(天)
-    MAX_BYTES = "10240"              // 单文件最大大小限制(MB)
-    DEBUG     = "true"                // 默认值，是否打开调试信息
+    LOG_PATH         = "/var/log/medlinker" // 日志目录
+    EXPIRE           = "30"                 // 过期时间(天)
+    MAX_BYTES        = "10240"              // 单文件最大大小限制(MB)
+    DEBUG            = "true"               // 默认值，是否打开调试信息
+    SEGMENT_ONLY     = "false"              // 默认值，是否只处理log-dumper已写入完成的分段文件
+    SEGMENT_DONE_EXT = ".done"              // 分段文件写入完成的标记文件后缀
+    DUMPER_STATE_DIR = "/__dumper_"         // log-dumper状态目录的名称前缀
 )
 
 var (
-    logPath  = genv.Get("LOG_PATH", LOG_PATH)
-    expire   = gconv.Int64(genv.Get("EXPIRE", EXPIRE))
-    maxBytes = gconv.Int64(genv.Get("MAX_BYTES", MAX_BYTES))*1024*1024
-    debug    = gconv.Bool(genv.Get("DEBUG", DEBUG))
+    logPath     = genv.Get("LOG_PATH", LOG_PATH)
+    expire      = gconv.Int64(genv.Get("EXPIRE", EXPIRE))
+    maxBytes    = gconv.Int64(genv.Get("MAX_BYTES", MAX_BYTES))*1024*1024
+    debug       = gconv.Bool(genv.Get("DEBUG", DEBUG))
+    segmentOnly = gconv.Bool(genv.Get("SEGMENT_ONLY", SEGMENT_ONLY))
 )
 
 func main() {
@@ -43,11 +50,24 @@ func main() {
 func handlerArchiveCron() {
     paths, _ := gfile.ScanDir(logPath, "*", true)
     for _, path := range paths {
-        // 不处理目录、kafka offset文件、已经压缩过的文件
-        if gfile.IsDir(path) || gfile.Ext(path) == ".offset" || gfile.Ext(path) == ".bz2" {
+        // 不处理log-dumper状态目录中的文件(offset长时间不变时文件不会更新，归档删除后offset会丢失)
+        if strings.Contains(path, DUMPER_STATE_DIR) {
+            glog.Debugfln(`ignore dumper state file %s`, path)
+            continue
+        }
+        // 不处理目录、kafka offset文件、已经压缩过的文件(包括log-dumper直接压缩输出的文件)
+        ext := gfile.Ext(path)
+        if gfile.IsDir(path) || ext == ".offset" || ext == ".bz2" || ext == ".gz" || ext == ".zst" || ext == SEGMENT_DONE_EXT {
             glog.Debugfln(`ignore file type %s`, path)
             continue
         }
+        // 分段文件可能仍在写入，只处理带有完成标记的文件；
+        // 没有完成标记但超过过期时间没有更新的文件(例如ROTATE_POLICY=none且不限制大小)同样视为写入完成
+        donePath := path + SEGMENT_DONE_EXT
+        if segmentOnly && !gfile.Exists(donePath) && gtime.Second() - gfile.MTime(path) < expire*86400 {
+            glog.Debugfln(`segment not completed %s`, path)
+            continue
+        }
         size := gfile.Size(path)
         if size < maxBytes {
             // 日志文件超过30天不再更新，那么执行归档
@@ -55,7 +75,7 @@ func handlerArchiveCron() {
                 glog.Debugfln(`file not expired %s`, path)
                 continue
             }
-        } else {
+        } else if !segmentOnly {
             // 超过文件大小限制(rename处理，dumper会识别到命名改变，更新文件指针)
             renamePath := path + ".1"
             existIndex := 2
@@ -86,6 +106,11 @@ func handlerArchiveCron() {
             if err := gfile.Remove(path); err != nil {
                 glog.Error(path, err)
             }
+            if segmentOnly && gfile.Exists(donePath) {
+                if err := gfile.Remove(donePath); err != nil {
+                    glog.Error(donePath, err)
+                }
+            }
         } else {
             glog.Error(path, err)
         }
@@ -16,6 +16,7 @@ const (
     EXPIRE              = "100"                 // (天)默认值，文件过期时间(超过该时间则删除文件)
     DEBUG               = "true"                // 默认值，是否打开调试信息
     AUTO_CHECK_INTERVAL = 3600                  // (秒)自动检测时间间隔
+    SEGMENT_DONE_EXT    = ".done"               // log-dumper分段文件写入完成的标记文件后缀
 )
 
 var (
@@ -33,19 +34,32 @@ func main() {
     }
 }
 
-// 清除过期的备份日志文件
+// 清除过期的备份日志文件: log-archiver生成的归档文件(.bz2)，以及log-dumper直接压缩输出并且已经写入完成(存在完成标记)的分段文件。
+// 没有完成标记的.gz/.zst文件是log-dumper正在写入(或者不切分)的输出文件，不属于备份文件，不会删除。
 func cleanExpiredBackupFiles() {
-    if list, err := gfile.ScanDir(logPath, "*.bz2", true); err == nil {
-        for _, path := range list {
-            if gfile.IsFile(path) && gtime.Second() - gfile.MTime(path) >= int64(expire * 86400) {
-                if err := gfile.Remove(path); err != nil {
-                    glog.Error(err)
-                } else {
-                    glog.Debug("removed file:", path)
-                }
+    list, err := gfile.ScanDir(logPath, "*.bz2,*.gz,*.zst", true)
+    if err != nil {
+        glog.Error(err)
+        return
+    }
+    for _, path := range list {
+        if !gfile.IsFile(path) || gtime.Second() - gfile.MTime(path) < int64(expire * 86400) {
+            continue
+        }
+        donePath := path + SEGMENT_DONE_EXT
+        if gfile.Ext(path) != ".bz2" && !gfile.Exists(donePath) {
+            glog.Debug("ignore uncompleted output file:", path)
+            continue
+        }
+        if err := gfile.Remove(path); err != nil {
+            glog.Error(path, err)
+            continue
+        }
+        glog.Debug("removed file:", path)
+        if gfile.Exists(donePath) {
+            if err := gfile.Remove(donePath); err != nil {
+                glog.Error(donePath, err)
             }
         }
-    } else {
-        glog.Error(err)
     }
 }
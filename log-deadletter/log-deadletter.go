@@ -0,0 +1,281 @@
+// 死信查看及重新发送工具.
+// log-dumper将无法解析或者分包不完整的kafka消息写入死信目录(或者DEAD_LETTER_TOPIC)，本工具用于:
+// 1. list   : 列出死信目录下的死信文件及记录数量；
+// 2. show   : 显示死信文件中的记录，可按照原因过滤；
+// 3. replay : 将死信记录中的原始消息重新发送到原topic(或者指定的topic)，由log-dumper重新处理；
+// 4. fetch  : 从DEAD_LETTER_TOPIC读取全部死信记录保存到本地文件，之后可使用show/replay处理。
+
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "github.com/Shopify/sarama"
+    "github.com/gogf/gf/g/os/genv"
+    "github.com/gogf/gf/g/os/gfile"
+    "k8s-log/internal/deadletter"
+    "k8s-log/internal/kafkaauth"
+    "os"
+    "strings"
+    "time"
+)
+
+const (
+    LOG_PATH             = "/var/log/medlinker"   // 日志目录
+    DEAD_LETTER_DIR_NAME = "__dumper_deadletters" // 死信目录名称
+    PREVIEW_SIZE         = 200                    // 显示死信时消息内容的预览长度
+    FETCH_IDLE_TIMEOUT   = 10*time.Second         // 读取DEAD_LETTER_TOPIC时没有新消息的最长等待时间
+)
+
+var (
+    logPath         = genv.Get("LOG_PATH", LOG_PATH)
+    kafkaAddr       = genv.Get("KAFKA_ADDR")
+    deadLetterTopic = genv.Get("DEAD_LETTER_TOPIC")
+    // kafka安全设置，与log-dumper相同
+    kafkaAuth       = kafkaauth.FromEnv()
+)
+
+func usage() {
+    fmt.Fprintln(os.Stderr, `usage:
+  log-deadletter list
+  log-deadletter show   [-reason REASON] FILE
+  log-deadletter replay [-reason REASON] [-topic TOPIC] FILE
+  log-deadletter fetch  FILE`)
+    os.Exit(2)
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        usage()
+    }
+    flags  := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+    reason := flags.String("reason", "", "only records whose reason contains REASON")
+    topic  := flags.String("topic", "", "replay to TOPIC instead of the original topic")
+    flags.Parse(os.Args[2 : ])
+    var err error
+    switch os.Args[1] {
+    case "list":
+        err = listDeadLetters()
+    case "show", "replay", "fetch":
+        if flags.NArg() != 1 {
+            usage()
+        }
+        switch os.Args[1] {
+        case "show":
+            err = showDeadLetters(flags.Arg(0), *reason)
+        case "replay":
+            err = replayDeadLetters(flags.Arg(0), *reason, *topic)
+        case "fetch":
+            err = fetchDeadLetters(flags.Arg(0))
+        }
+    default:
+        usage()
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+}
+
+// 读取死信文件，对符合原因过滤条件的记录执行f
+func readDeadLetters(path string, reason string, f func(line int, letter *deadletter.DeadLetter) error) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 1024*1024), 1024*1024*1024)
+    for line := 1; scanner.Scan(); line++ {
+        letter := &deadletter.DeadLetter{}
+        if err := json.Unmarshal(scanner.Bytes(), letter); err != nil {
+            fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, line, err.Error())
+            continue
+        }
+        if reason != "" && !strings.Contains(letter.Reason, reason) {
+            continue
+        }
+        if err := f(line, letter); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+// 列出死信目录下的死信文件及记录数量
+func listDeadLetters() error {
+    dir  := fmt.Sprintf("%s/%s", logPath, DEAD_LETTER_DIR_NAME)
+    list, err := gfile.ScanDir(dir, "*.jsonl", true)
+    if err != nil {
+        return err
+    }
+    for _, path := range list {
+        count := 0
+        if err := readDeadLetters(path, "", func(line int, letter *deadletter.DeadLetter) error {
+            count++
+            return nil
+        }); err != nil {
+            return err
+        }
+        fmt.Printf("%8d  %s\n", count, path)
+    }
+    return nil
+}
+
+// 显示死信文件中的记录
+func showDeadLetters(path string, reason string) error {
+    return readDeadLetters(path, reason, func(line int, letter *deadletter.DeadLetter) error {
+        fmt.Printf("#%d %s %s[%d]@%d key=%s packages=%d reason=%s\n",
+            line, letter.Time, letter.Topic, letter.Partition, letter.Offset, string(letter.Key), len(letter.Packages), letter.Reason,
+        )
+        for i, pkg := range letter.Packages {
+            preview := string(pkg)
+            if len(preview) > PREVIEW_SIZE {
+                preview = preview[ : PREVIEW_SIZE] + "..."
+            }
+            fmt.Printf("    [%d] %d bytes: %s\n", i + 1, len(pkg), preview)
+        }
+        return nil
+    })
+}
+
+// 创建kafka配置
+func newKafkaConfig() (*sarama.Config, error) {
+    if kafkaAddr == "" {
+        return nil, fmt.Errorf("incomplete kafka settings: KAFKA_ADDR")
+    }
+    config := sarama.NewConfig()
+    config.Producer.Return.Successes = true
+    config.Producer.RequiredAcks     = sarama.WaitForAll
+    return config, kafkaAuth.Apply(config)
+}
+
+// 将死信记录中的原始消息按照分包顺序重新发送，使用原消息的key保证分包写入同一个partition
+func replayDeadLetters(path string, reason string, topic string) error {
+    config, err := newKafkaConfig()
+    if err != nil {
+        return err
+    }
+    producer, err := sarama.NewSyncProducer(strings.Split(kafkaAddr, ","), config)
+    if err != nil {
+        return err
+    }
+    defer producer.Close()
+    count := 0
+    err = readDeadLetters(path, reason, func(line int, letter *deadletter.DeadLetter) error {
+        target := letter.Topic
+        if topic != "" {
+            target = topic
+        }
+        for _, pkg := range letter.Packages {
+            msg := &sarama.ProducerMessage {
+                Topic : target,
+                Value : sarama.ByteEncoder(pkg),
+            }
+            if len(letter.Key) > 0 {
+                msg.Key = sarama.ByteEncoder(letter.Key)
+            }
+            if _, _, err := producer.SendMessage(msg); err != nil {
+                return fmt.Errorf("%s:%d: %s", path, line, err.Error())
+            }
+        }
+        count++
+        return nil
+    })
+    fmt.Printf("%d dead letters replayed\n", count)
+    return err
+}
+
+// 从DEAD_LETTER_TOPIC读取全部死信记录(读取到开始读取时的最新位置为止)，追加保存到本地文件
+func fetchDeadLetters(path string) error {
+    if deadLetterTopic == "" {
+        return fmt.Errorf("incomplete settings: DEAD_LETTER_TOPIC")
+    }
+    config, err := newKafkaConfig()
+    if err != nil {
+        return err
+    }
+    client, err := sarama.NewClient(strings.Split(kafkaAddr, ","), config)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    consumer, err := sarama.NewConsumerFromClient(client)
+    if err != nil {
+        return err
+    }
+    defer consumer.Close()
+    partitions, err := client.Partitions(deadLetterTopic)
+    if err != nil {
+        return err
+    }
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    count := 0
+    for _, partition := range partitions {
+        newest, err := client.GetOffset(deadLetterTopic, partition, sarama.OffsetNewest)
+        if err != nil {
+            return err
+        }
+        oldest, err := client.GetOffset(deadLetterTopic, partition, sarama.OffsetOldest)
+        if err != nil {
+            return err
+        }
+        if oldest >= newest {
+            continue
+        }
+        pc, err := consumer.ConsumePartition(deadLetterTopic, partition, oldest)
+        if err != nil {
+            return err
+        }
+        n, err := fetchPartition(pc, file, oldest, newest)
+        pc.Close()
+        count += n
+        if err != nil {
+            return err
+        }
+    }
+    fmt.Printf("%d dead letters fetched to %s\n", count, path)
+    return nil
+}
+
+// 读取partition中offset在[oldest, newest)之间的死信记录写入文件，返回写入的记录数量。
+// 最后的offset可能是事务控制记录或者已被压缩删除，对应的消息永远不会到达，
+// 因此超过FETCH_IDLE_TIMEOUT没有新消息时，按照high water mark判断已读取完毕并结束。
+func fetchPartition(pc sarama.PartitionConsumer, file *os.File, oldest, newest int64) (int, error) {
+    count := 0
+    next  := oldest
+    idle  := time.NewTimer(FETCH_IDLE_TIMEOUT)
+    defer idle.Stop()
+    for {
+        select {
+        case msg, ok := <-pc.Messages():
+            if !ok {
+                return count, nil
+            }
+            if _, err := file.Write(append(msg.Value, '\n')); err != nil {
+                return count, err
+            }
+            count++
+            next = msg.Offset + 1
+            if next >= newest {
+                return count, nil
+            }
+            if !idle.Stop() {
+                <-idle.C
+            }
+            idle.Reset(FETCH_IDLE_TIMEOUT)
+
+        case <-idle.C:
+            if hwm := pc.HighWaterMarkOffset(); next < hwm && next < newest {
+                fmt.Fprintf(os.Stderr, "partition stopped at offset %d before high water mark %d (transaction markers or compacted messages)\n", next, hwm)
+            }
+            return count, nil
+        }
+    }
+}
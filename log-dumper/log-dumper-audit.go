@@ -0,0 +1,141 @@
+package main
+
+import (
+    "fmt"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gkafka"
+    "sync"
+)
+
+const (
+    AUDIT_EVENT_GAP       = "gap"       // 序列号跳跃，中间的消息未到达(可能丢失)
+    AUDIT_EVENT_DUPLICATE = "duplicate" // 已处理过的序列号(客户端重发)
+    AUDIT_EVENT_REORDER   = "reorder"   // 之前判定为未到达的序列号晚到(乱序)
+    AUDIT_EVENT_OVERLAP   = "overlap"   // 连续序列号的消息字节范围重叠
+    AUDIT_EVENT_HOLE      = "hole"      // 连续序列号的消息字节范围不连续
+)
+
+// 单个节点上单个日志文件的序列号状态
+type auditStream struct {
+    mu      sync.Mutex
+    epoch   int64            // 当前文件标识
+    seq     int64            // 已到达的最大序列号
+    end     int64            // 已到达的最大序列号消息的结束位置
+    gaps    map[int64]bool   // 未到达的序列号
+    updated int64            // 最后更新时间(秒)
+}
+
+var (
+    // 日志文件序列号状态，键名为getAuditStreamKey生成的key
+    auditStreamMap = gmap.NewStringInterfaceMap()
+)
+
+// 生成序列号状态的key: 主机名称 + 日志文件路径。
+// 轮转压缩文件的文件标识由文件指纹生成，与日志文件的文件标识没有先后关系，每个压缩文件单独检测
+func getAuditStreamKey(msg *Message) string {
+    if msg.Rotated {
+        return fmt.Sprintf("%s:%s:rotated:%d", msg.Host, msg.Path, msg.Epoch)
+    }
+    return msg.Host + ":" + msg.Path
+}
+
+// 对带有序列号的消息进行丢失、重复及乱序检测，检测结果记录到监控指标及审计日志中
+func auditMessage(msg *Message, kafkaMsg *gkafka.Message) {
+    if msg.Epoch == 0 || msg.Seq == 0 {
+        return
+    }
+    stream := auditStreamMap.GetOrSetFuncLock(getAuditStreamKey(msg), func() interface{} {
+        return &auditStream{}
+    }).(*auditStream)
+    stream.mu.Lock()
+    defer stream.mu.Unlock()
+    stream.updated = gtime.Second()
+    // 第一次收到该文件的消息(例如转储端重启后)，无法判断之前的消息，从当前序列号开始检测
+    if stream.epoch == 0 {
+        stream.reset(msg)
+        return
+    }
+    switch {
+    case msg.Epoch < stream.epoch:
+        // 文件被重新创建后，旧文件的消息晚到
+        writeAuditEvent(kafkaMsg, msg, AUDIT_EVENT_REORDER, "stale epoch, current %d", stream.epoch)
+        return
+
+    case msg.Epoch > stream.epoch:
+        // 新文件的序列号从1开始
+        if msg.Seq > 1 {
+            writeAuditEvent(kafkaMsg, msg, AUDIT_EVENT_GAP, "new epoch, missing seq [1, %d)", msg.Seq)
+            addSequenceGap(kafkaMsg.Topic, msg.Seq - 1)
+        }
+        stream.reset(msg)
+        return
+
+    case msg.Seq == stream.seq + 1:
+        if msg.Start > stream.end {
+            writeAuditEvent(kafkaMsg, msg, AUDIT_EVENT_HOLE, "missing bytes [%d, %d)", stream.end, msg.Start)
+        } else if msg.Start < stream.end {
+            writeAuditEvent(kafkaMsg, msg, AUDIT_EVENT_OVERLAP, "overlapped bytes [%d, %d)", msg.Start, stream.end)
+        }
+
+    case msg.Seq > stream.seq + 1:
+        writeAuditEvent(kafkaMsg, msg, AUDIT_EVENT_GAP, "missing seq [%d, %d)", stream.seq + 1, msg.Seq)
+        addSequenceGap(kafkaMsg.Topic, msg.Seq - stream.seq - 1)
+        for seq := stream.seq + 1; seq < msg.Seq && len(stream.gaps) < auditMaxGaps; seq++ {
+            stream.gaps[seq] = true
+        }
+
+    default:
+        if stream.gaps[msg.Seq] {
+            delete(stream.gaps, msg.Seq)
+            writeAuditEvent(kafkaMsg, msg, AUDIT_EVENT_REORDER, "late seq, current %d", stream.seq)
+        } else {
+            writeAuditEvent(kafkaMsg, msg, AUDIT_EVENT_DUPLICATE, "current seq %d", stream.seq)
+        }
+        return
+    }
+    stream.seq = msg.Seq
+    stream.end = msg.End
+}
+
+// 使用消息的文件标识及序列号重置状态
+func (s *auditStream) reset(msg *Message) {
+    s.epoch = msg.Epoch
+    s.seq   = msg.Seq
+    s.end   = msg.End
+    s.gaps  = make(map[int64]bool)
+}
+
+// 记录检测事件到监控指标及审计日志(按天保存)
+func writeAuditEvent(kafkaMsg *gkafka.Message, msg *Message, event string, format string, params...interface{}) {
+    addSequenceEvent(kafkaMsg.Topic, event)
+    content := fmt.Sprintf("%s %s topic=%s partition=%d offset=%d host=%s path=%s epoch=%d seq=%d range=[%d,%d) %s\n",
+        gtime.Datetime(), event, kafkaMsg.Topic, kafkaMsg.Partition, kafkaMsg.Offset,
+        msg.Host, msg.Path, msg.Epoch, msg.Seq, msg.Start, msg.End, fmt.Sprintf(format, params...),
+    )
+    glog.Debug(content)
+    if dryrun {
+        return
+    }
+    path := fmt.Sprintf("%s/%s/%s.log", logPath, AUDIT_DIR_NAME, gtime.Date())
+    if err := gfile.PutContentsAppend(path, content); err != nil {
+        glog.Error(err)
+    }
+}
+
+// 清理长时间没有新消息的日志文件序列号状态
+func cleanAuditStreamCron() {
+    now := gtime.Second()
+    for _, key := range auditStreamMap.Keys() {
+        if stream, ok := auditStreamMap.Get(key).(*auditStream); ok {
+            stream.mu.Lock()
+            expired := now - stream.updated > auditStreamTtl
+            stream.mu.Unlock()
+            if expired {
+                auditStreamMap.Remove(key)
+            }
+        }
+    }
+}
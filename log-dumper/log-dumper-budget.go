@@ -0,0 +1,98 @@
+package main
+
+import (
+    "sync"
+)
+
+const (
+    BUFFER_ITEM_OVERHEAD = 160 // (字节)每条缓冲记录除日志内容之外占用的内存估计值
+)
+
+// 所有输出文件缓冲区共用的内存预算，超过预算时添加记录的协程阻塞等待(对kafka消费形成反压)，
+// 同时写入任务将缓冲区中记录的内容写入磁盘以释放内存
+type memoryBudget struct {
+    mu      sync.Mutex
+    cond    *sync.Cond
+    used    int64 // (字节)已使用的内存
+    limit   int64 // (字节)内存预算
+    waiting int   // 等待内存的协程数量
+    needed  int64 // (字节)等待中的协程申请的内存
+}
+
+var (
+    // 输出文件缓冲区的内存预算
+    bufferBudget = newMemoryBudget(bufferMaxMemory)
+)
+
+func newMemoryBudget(limit int64) *memoryBudget {
+    b := &memoryBudget{limit : limit}
+    b.cond = sync.NewCond(&b.mu)
+    return b
+}
+
+// 估计缓冲记录占用的内存，内容已写入磁盘的记录只计算记录本身(写入文件前临时读取的内容不计算)
+func getItemMemory(item *bufferItem) int64 {
+    if item.spill != nil {
+        return BUFFER_ITEM_OVERHEAD
+    }
+    return int64(len(item.content) + BUFFER_ITEM_OVERHEAD)
+}
+
+// 申请内存，超过预算或者ready返回false时阻塞等待记录写入后释放内存。
+// 没有已使用的内存时总是可以申请，防止单条记录超过预算时永久阻塞。
+func (b *memoryBudget) acquire(size int64, ready func() bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for (b.used > 0 && b.used + size > b.limit) || !ready() {
+        b.waiting++
+        b.needed += size
+        b.cond.Wait()
+        b.waiting--
+        b.needed -= size
+    }
+    b.used += size
+}
+
+// 释放内存并唤醒等待的协程
+func (b *memoryBudget) release(size int64) {
+    if size == 0 {
+        return
+    }
+    b.mu.Lock()
+    b.used -= size
+    b.mu.Unlock()
+    b.cond.Broadcast()
+}
+
+// 释放记录占用的内存
+func (b *memoryBudget) releaseItems(items []*bufferItem) {
+    size := int64(0)
+    for _, item := range items {
+        size += getItemMemory(item)
+    }
+    b.release(size)
+}
+
+// 是否有协程在等待内存，此时写入任务将缓冲区中记录的内容写入磁盘
+func (b *memoryBudget) exhausted() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.waiting > 0
+}
+
+// 等待中的协程都能申请到内存需要释放的内存大小
+func (b *memoryBudget) shortage() int64 {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if size := b.used + b.needed - b.limit; size > 0 {
+        return size
+    }
+    return 0
+}
+
+// 已使用的内存
+func (b *memoryBudget) usage() int64 {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.used
+}
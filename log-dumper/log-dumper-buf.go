@@ -1,62 +1,114 @@
 package main
 
 import (
-    "github.com/gogf/gf/g/container/garray"
     "github.com/gogf/gkafka"
     "github.com/gogf/gf/g/os/gtime"
     "github.com/gogf/gf/g/util/gconv"
     "github.com/gogf/gf/g/text/gstr"
-    "time"
+)
+
+const (
+    LATE_POLICY_INPLACE = "inplace" // 延迟记录直接写入输出文件(不保证顺序)
+    LATE_POLICY_FILE    = "file"    // 延迟记录写入单独的.late文件
+    LATE_POLICY_DROP    = "drop"    // 丢弃延迟记录
+    LATE_FILE_EXT       = ".late"   // 延迟记录文件后缀
 )
 
 // 排序元素项
 type bufferItem struct {
-    mtime     int64  // 毫秒时间戳
-    content   string // 日志内容
-    offset    int    // kafka offset
-    topic     string // kafka topic
-    partition int    // kafka partition
+    mtime     int64        // 毫秒时间戳
+    seq       int64        // 消息序列号(旧版本客户端为0)
+    index     int          // 记录在消息中的序号
+    content   string       // 日志内容
+    offset    int          // kafka offset
+    topic     string       // kafka topic
+    partition int          // kafka partition
+    rng       *recordRange // 日志记录在源文件中的字节范围(旧版本客户端为nil)
+    late      bool         // 是否为延迟记录(日志时间早于已写入的水位线)
+    meta      *recordMeta  // 日志记录的来源信息
+    unit      *commitUnit  // 日志记录所属消息的处理单元，写入文件后标记完成
+    spill     *spillRef    // 内存预算不足时日志内容写入磁盘的位置，为nil时内容保存在内存中
 }
 
-// 添加日志内容到缓冲区
-func addToBufferArray(msg *Message, kafkaMsg *gkafka.Message) {
-    // array是并发安全的
-    array := bufferMap.GetOrSetFuncLock(msg.Path, func() interface{} {
-        return garray.NewSortedArray(func(v1, v2 interface{}) int {
-            item1 := v1.(*bufferItem)
-            item2 := v2.(*bufferItem)
-            // 两个日志项只能排前面或者后面，不能存在相等情况，否则会覆盖
-            if item1.mtime < item2.mtime {
-                return -1
-            } else {
-                return 1
-            }
-        })
-    }).(*garray.SortedArray)
-
-    // 判断缓冲区阈值
-    for array.Len() > bufferLength {
-        //glog.Debugfln(`%s exceeds max buffer length: %d > %d, waiting..`, msg.Path, array.Len(), bufferLength)
-        time.Sleep(time.Second)
+// 添加日志内容到缓冲区，ranges为日志记录对应的字节范围(可为nil)，unit为消息的处理单元。
+// 日志记录按照输出路径模板写入各自输出文件的缓冲区(模板包含日期等变量时同一消息的记录可能属于不同的文件)，
+// outputPath不为空时(已经由其他副本按照模板计算)所有记录写入该文件。
+func addToBufferArray(msg *Message, kafkaMsg *gkafka.Message, ranges []*recordRange, unit *commitUnit, outputPath string) {
+    meta := &recordMeta {
+        host      : msg.Host,
+        namespace : msg.Namespace,
+        pod       : msg.Pod,
+        container : msg.Container,
+        path      : msg.Path,
+        time      : msg.Time,
     }
-
-    for _, v := range msg.Msgs {
-        t := getTimeFromContent(v)
-        if t == nil || t.IsZero() {
-            //glog.Debugfln(`cannot parse time from [%s] %s: %s`, msg.Host, msg.Path, v)
-            t = gtime.Now()
+    for k, v := range msg.Msgs {
+        t    := getRecordTime(v)
+        path := outputPath
+        if path == "" {
+            path = buildOutputPath(msg, kafkaMsg, t)
         }
-        array.Add(&bufferItem {
+        buffer := getMergeBuffer(path)
+        item   := &bufferItem {
             mtime     : t.Millisecond(),
+            seq       : msg.Seq,
+            index     : k,
             content   : v,
             topic     : kafkaMsg.Topic,
             offset    : kafkaMsg.Offset,
             partition : kafkaMsg.Partition,
+            meta      : meta,
+            unit      : unit,
+        }
+        if ranges != nil {
+            item.rng = ranges[k]
+        }
+        if buffer.IsLate(item.mtime) && !handleLateRecord(item) {
+            item.unit.done()
+            continue
+        }
+        // 超过全局内存预算或者缓冲区容量时阻塞等待记录写入(对kafka消费形成反压)
+        bufferBudget.acquire(getItemMemory(item), func() bool {
+            return buffer.Len() <= bufferLength
         })
+        buffer.Add(msg.Host + ":" + msg.Path, item)
         //glog.Debug("addToBufferArray:", msg.Path, k, len(msg.Msgs))
     }
 }
 
+// 处理延迟记录，返回是否需要添加到缓冲区
+func handleLateRecord(item *bufferItem) bool {
+    addLateRecord(item.topic, latePolicy)
+    switch latePolicy {
+    case LATE_POLICY_DROP:
+        // 丢弃的记录同样视为已处理，重发时不再接收
+        if item.rng != nil {
+            markWrittenRanges([]*recordRange{item.rng})
+        }
+        return false
+    case LATE_POLICY_FILE:
+        item.late = true
+    }
+    return true
+}
+
+// 获取输出文件的缓冲区，buffer是并发安全的
+func getMergeBuffer(path string) *mergeBuffer {
+    return bufferMap.GetOrSetFuncLock(path, func() interface{} {
+        return newMergeBuffer()
+    }).(*mergeBuffer)
+}
+
+// 获取日志记录的时间，无法从内容中解析时使用当前时间
+func getRecordTime(content string) *gtime.Time {
+    t := getTimeFromContent(content)
+    if t == nil || t.IsZero() {
+        //glog.Debugfln(`cannot parse time from: %s`, content)
+        t = gtime.Now()
+    }
+    return t
+}
+
 // 从内容中解析出日志的时间，并返回对应的日期对象
 func getTimeFromContent(content string) *gtime.Time {
     if t := gtime.ParseTimeFromContent(content); t != nil {
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "container/list"
+    "sync"
+    "sync/atomic"
+)
+
+// kafka partition的offset提交记录，消息按照接收顺序排列，
+// 只有之前的消息都处理完成(写入文件、写入死信或者被过滤)后才推进提交的offset
+type partitionTracker struct {
+    mu     sync.Mutex
+    items  *list.List       // 已接收未提交的消息
+    commit func(offset int) // 推进offset时的回调
+}
+
+// 提交记录中的一条kafka消息
+type offsetItem struct {
+    offset int
+    done   bool
+}
+
+// 一条kafka消息在提交记录中的引用
+type offsetRef struct {
+    tracker *partitionTracker
+    element *list.Element
+}
+
+// 一条完整消息(可能由多个分包组成)的处理单元，消息中的日志记录都写入文件后，所有分包的offset才能被提交
+type commitUnit struct {
+    remaining int32
+    refs      []*offsetRef
+}
+
+func newPartitionTracker(commit func(offset int)) *partitionTracker {
+    return &partitionTracker {
+        items  : list.New(),
+        commit : commit,
+    }
+}
+
+// 记录接收到的kafka消息，需要按照接收顺序调用
+func (t *partitionTracker) begin(offset int) *offsetRef {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return &offsetRef {
+        tracker : t,
+        element : t.items.PushBack(&offsetItem{offset : offset}),
+    }
+}
+
+// 标记kafka消息处理完成，并推进已完成的连续消息的offset
+func (r *offsetRef) done() {
+    t := r.tracker
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    r.element.Value.(*offsetItem).done = true
+    offset := -1
+    for front := t.items.Front(); front != nil && front.Value.(*offsetItem).done; front = t.items.Front() {
+        offset = front.Value.(*offsetItem).offset
+        t.items.Remove(front)
+    }
+    if offset >= 0 {
+        t.commit(offset)
+    }
+}
+
+// 标记多条kafka消息处理完成
+func doneOffsetRefs(refs []*offsetRef) {
+    for _, ref := range refs {
+        ref.done()
+    }
+}
+
+// 创建处理单元，count为需要写入的日志记录数量，为0时直接标记完成
+func newCommitUnit(refs []*offsetRef, count int) *commitUnit {
+    if count == 0 {
+        doneOffsetRefs(refs)
+        return nil
+    }
+    return &commitUnit {
+        remaining : int32(count),
+        refs      : refs,
+    }
+}
+
+// 标记一条日志记录处理完成
+func (u *commitUnit) done() {
+    if u != nil && atomic.AddInt32(&u.remaining, -1) == 0 {
+        doneOffsetRefs(u.refs)
+    }
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "github.com/klauspost/compress/zstd"
+)
+
+const (
+    OUTPUT_COMPRESSION_NONE = "none" // 不压缩
+    OUTPUT_COMPRESSION_GZIP = "gzip" // gzip压缩，文件后缀.gz
+    OUTPUT_COMPRESSION_ZSTD = "zstd" // zstd压缩，文件后缀.zst
+)
+
+var (
+    // zstd编码器，EncodeAll可以并发使用
+    zstdEncoder *zstd.Encoder
+)
+
+func init() {
+    if outputCompression == OUTPUT_COMPRESSION_ZSTD {
+        encoder, err := zstd.NewWriter(nil)
+        if err != nil {
+            panic(err)
+        }
+        zstdEncoder = encoder
+    }
+}
+
+// 获取压缩输出文件的后缀
+func getCompressionExt() string {
+    switch outputCompression {
+    case OUTPUT_COMPRESSION_GZIP:
+        return ".gz"
+    case OUTPUT_COMPRESSION_ZSTD:
+        return ".zst"
+    }
+    return ""
+}
+
+// 将一批写入内容压缩为独立的gzip member或者zstd frame。
+// 多个member/frame顺序拼接仍然是合法的压缩文件，每批写入后文件都可以被完整解压，
+// 读取端可以在写入过程中跟踪文件内容，分段结束时不需要额外的收尾操作。
+func compressContent(content []byte) []byte {
+    switch outputCompression {
+    case OUTPUT_COMPRESSION_GZIP:
+        buffer := bytes.NewBuffer(nil)
+        writer := gzip.NewWriter(buffer)
+        // 写入内存缓冲区不会失败
+        writer.Write(content)
+        writer.Close()
+        return buffer.Bytes()
+
+    case OUTPUT_COMPRESSION_ZSTD:
+        return zstdEncoder.EncodeAll(content, make([]byte, 0, len(content)/4))
+    }
+    return content
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+    "encoding/json"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gkafka"
+    "net/http"
+    "regexp"
+    "sort"
+    "sync"
+    "time"
+)
+
+const (
+    CONSUMER_STATE_STARTING = "starting" // 正在连接kafka
+    CONSUMER_STATE_RUNNING  = "running"  // 正在消费
+    CONSUMER_STATE_BACKOFF  = "backoff"  // 连接失败，等待重新连接
+    CONSUMER_STATE_STOPPED  = "stopped"  // 已停止(topic被删除)
+)
+
+// topic消费端，消费出错时按照指数退避时间重新连接，topic被删除时停止
+type topicConsumer struct {
+    mu        sync.Mutex
+    topic     string
+    state     string
+    client    *gkafka.Client // 当前连接的kafka客户端
+    restarts  int            // 重新连接次数
+    failures  int            // 连续失败次数
+    lastError string         // 最近一次错误
+    since     int64          // (秒)进入当前状态的时间
+    stopped   bool
+    stop      chan struct{}
+}
+
+// 消费端状态，用于/consumers接口输出
+type consumerStatus struct {
+    Topic     string `json:"topic"`
+    State     string `json:"state"`
+    Restarts  int    `json:"restarts"`
+    Failures  int    `json:"failures"`
+    LastError string `json:"last_error,omitempty"`
+    Since     int64  `json:"since"`
+}
+
+var (
+    // 所有topic的消费端，键名为topic
+    consumerMap = gmap.NewStringInterfaceMap()
+)
+
+// 编译topic过滤正则，为空时返回nil
+func compileTopicRegex(pattern string) *regexp.Regexp {
+    if pattern == "" {
+        return nil
+    }
+    return regexp.MustCompile(pattern)
+}
+
+// 判断topic是否需要消费
+func isTopicIncluded(topic string) bool {
+    // 不消费死信topic及横向扩展模式的转发topic
+    if topic == deadLetterTopic || topic == routeTopic {
+        return false
+    }
+    if topicIncludeRegex != nil && !topicIncludeRegex.MatchString(topic) {
+        return false
+    }
+    if topicExcludeRegex != nil && topicExcludeRegex.MatchString(topic) {
+        return false
+    }
+    return true
+}
+
+// 根据连续失败次数计算退避时间: CONSUMER_BACKOFF_MIN*2^(failures-1)，不超过CONSUMER_BACKOFF_MAX
+func getBackoff(failures int) time.Duration {
+    backoff := consumerBackoffMin
+    for i := 1; i < failures && backoff < consumerBackoffMax; i++ {
+        backoff *= 2
+    }
+    if backoff > consumerBackoffMax {
+        backoff = consumerBackoffMax
+    }
+    return time.Duration(backoff)*time.Second
+}
+
+// 定时获取kafka topic列表，启动新topic的消费端并停止已删除topic的消费端，获取失败时按照退避时间重试
+func runConsumerManager() {
+    failures := 0
+    for {
+        topics, err := kafkaClient.Topics()
+        if err != nil {
+            failures++
+            glog.Errorfln("cannot get kafka topics, retry in %v: %s", getBackoff(failures), err.Error())
+            time.Sleep(getBackoff(failures))
+            continue
+        }
+        failures = 0
+        syncConsumers(topics)
+        time.Sleep(TOPIC_AUTO_CHECK_INTERVAL*time.Second)
+    }
+}
+
+// 根据topic列表启动或者停止消费端
+func syncConsumers(topics []string) {
+    exists := make(map[string]bool, len(topics))
+    for _, topic := range topics {
+        if !isTopicIncluded(topic) {
+            continue
+        }
+        exists[topic] = true
+        if !consumerMap.Contains(topic) {
+            glog.Debugfln("add new topic handle: %s", topic)
+            c := &topicConsumer {
+                topic : topic,
+                state : CONSUMER_STATE_STARTING,
+                since : gtime.Second(),
+                stop  : make(chan struct{}),
+            }
+            consumerMap.Set(topic, c)
+            topicMap.Set(topic, gmap.NewStringIntMap())
+            go c.run()
+        }
+    }
+    for _, topic := range consumerMap.Keys() {
+        if !exists[topic] {
+            if c, ok := consumerMap.Get(topic).(*topicConsumer); ok {
+                glog.Debugfln("stop deleted topic handle: %s", topic)
+                c.shutdown()
+            }
+        }
+    }
+}
+
+// 消费端主循环
+func (c *topicConsumer) run() {
+    offsetMap := topicMap.Get(c.topic).(*gmap.StringIntMap)
+    // 只在第一次连接时从存储中读取offset，重新连接时使用内存中的offset，
+    // 横向扩展模式下partition在副本之间分配，以消费分组提交的offset为准
+    if scaleMode != SCALE_MODE_ROUTE {
+        initOffsetMap(c.topic, offsetMap)
+    }
+    for {
+        started := gtime.Second()
+        err     := handlerKafkaTopic(c, offsetMap)
+        if c.isStopped() {
+            break
+        }
+        c.mu.Lock()
+        // 长时间正常运行后的失败重新计算退避时间
+        if gtime.Second() - started > consumerBackoffMax {
+            c.failures = 0
+        }
+        c.failures++
+        if err != nil {
+            c.lastError = err.Error()
+        }
+        backoff := getBackoff(c.failures)
+        c.setState(CONSUMER_STATE_BACKOFF)
+        c.mu.Unlock()
+        glog.Errorfln("consumer of topic %s failed, reconnect in %v: %v", c.topic, backoff, err)
+        select {
+        case <-c.stop:
+        case <-time.After(backoff):
+        }
+        if c.isStopped() {
+            break
+        }
+        c.mu.Lock()
+        c.restarts++
+        c.setState(CONSUMER_STATE_STARTING)
+        c.mu.Unlock()
+        addConsumerRestart(c.topic)
+    }
+    // 保存已处理的offset后清理topic状态
+    dumpOffsetMap(c.topic, offsetMap)
+    topicMap.Remove(c.topic)
+    consumerMap.Remove(c.topic)
+    c.mu.Lock()
+    c.setState(CONSUMER_STATE_STOPPED)
+    c.mu.Unlock()
+}
+
+// 设置消费端状态，需要在加锁后调用
+func (c *topicConsumer) setState(state string) {
+    c.state = state
+    c.since = gtime.Second()
+}
+
+// 创建kafka客户端，消费端已停止时返回nil
+func (c *topicConsumer) connect() *gkafka.Client {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.stopped {
+        return nil
+    }
+    c.client = newKafkaClient(c.topic)
+    c.setState(CONSUMER_STATE_RUNNING)
+    return c.client
+}
+
+// 关闭当前的kafka客户端
+func (c *topicConsumer) disconnect() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.client != nil {
+        c.client.Close()
+        c.client = nil
+    }
+}
+
+// 停止消费端，关闭kafka客户端使阻塞的Receive返回
+func (c *topicConsumer) shutdown() {
+    c.mu.Lock()
+    if c.stopped {
+        c.mu.Unlock()
+        return
+    }
+    c.stopped = true
+    close(c.stop)
+    c.mu.Unlock()
+    c.disconnect()
+}
+
+func (c *topicConsumer) isStopped() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.stopped
+}
+
+func (c *topicConsumer) status() *consumerStatus {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return &consumerStatus {
+        Topic     : c.topic,
+        State     : c.state,
+        Restarts  : c.restarts,
+        Failures  : c.failures,
+        LastError : c.lastError,
+        Since     : c.since,
+    }
+}
+
+// 输出所有消费端的状态(JSON)
+func handleConsumerStatus(w http.ResponseWriter, r *http.Request) {
+    list := make([]*consumerStatus, 0)
+    for _, topic := range consumerMap.Keys() {
+        if c, ok := consumerMap.Get(topic).(*topicConsumer); ok {
+            list = append(list, c.status())
+        }
+    }
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Topic < list[j].Topic
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(list)
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
-    "bytes"
-    "github.com/gogf/gf/g/container/garray"
     "github.com/gogf/gf/g/container/gmap"
-    "github.com/gogf/gf/g/os/gfile"
     "github.com/gogf/gf/g/os/glog"
     "github.com/gogf/gf/g/os/gmlock"
     "github.com/gogf/gf/g/os/gtime"
-    "time"
+)
+
+var (
+    // (秒)正在写入的输出文件及开始写入的时间
+    writingMap = gmap.NewStringIntMap()
 )
 
 // 异步批量保存日志
 func handlerSavingContent() {
+    // 内存预算不足时各缓冲区按照占用内存的比例分摊需要释放的内存
+    shortage := int64(0)
+    used     := int64(0)
+    if bufferBudget.exhausted() {
+        shortage = bufferBudget.shortage()
+        used     = bufferBudget.usage()
+    }
     // 批量写日志
     keys := bufferMap.Keys()
     for _, key := range keys {
@@ -24,72 +32,87 @@ func handlerSavingContent() {
                 glog.Info(path, "is already saving...")
                 return
             }
-            array := bufferMap.Get(path).(*garray.SortedArray)
-            if array.Len() > 0 {
-                minTime := int64(0)
-                maxTime := int64(0)
-                if array.Len() > 0 {
-                    // 队列最小时间与当前时间的间隔比较(而不是队列两端大小的比较)
-                    minTime = array.Get(0).(*bufferItem).mtime
-                    maxTime = gtime.Millisecond()
-                }
-                buffer       := bytes.NewBuffer(nil)
-                bufferCount  := 0
-                tmpOffsetMap := gmap.NewStringIntMap()
-                for i := 0; i < array.Len(); i++ {
-                    item := array.Get(0).(*bufferItem)
-                    // 超过缓冲区时间则写入文件
-                    if maxTime - minTime >= bufferTime*1000 && bufferCount < bufferLength {
-                        // 记录写入的kafka offset
-                        key := buildOffsetKey(item.topic, item.partition)
-                        if item.offset > tmpOffsetMap.Get(key) {
-                            tmpOffsetMap.Set(key, item.offset)
-                        }
-                        buffer.WriteString(item.content)
-                        array.PopLeft()
-                        bufferCount++
-                    } else {
-                        break
-                    }
-                }
-                for buffer.Len() > 0 {
-                    if err := gfile.PutBinContentsAppend(path, buffer.Bytes()); err != nil {
-                        // 如果日志写失败，等待1秒后继续
-                        glog.Error(err)
-                        time.Sleep(time.Second)
-                    } else {
-                        // 真实写入成功之后才写入kafka offset到全局的offset哈希表中，以便磁盘化
-                        if tmpOffsetMap.Size() > 0 {
-                            for key, offset := range tmpOffsetMap.Map() {
-                                topic, partition := parseOffsetKey(key)
-                                if topic != "" {
-                                    setOffsetMap(topic, partition, offset)
-                                } else {
-                                    glog.Error("cannot parse key:", key)
-                                }
-                            }
-                        }
-                        glog.Debugfln("%s : %d, %d, %d, %s, %s", path, buffer.Len(), bufferCount, array.Len(),
-                            gtime.NewFromTimeStamp(minTime).Format("Y-m-d H:i:s.u"),
-                            gtime.NewFromTimeStamp(maxTime).Format("Y-m-d H:i:s.u"),
-                        )
-                        buffer.Reset()
-                        break
-                    }
+            buffer := bufferMap.Get(path).(*mergeBuffer)
+            if buffer.Len() > 0 {
+                if used > 0 {
+                    // 内存预算不足时不提前写入记录，而是将记录的内容写入磁盘(按照占用内存的比例分摊需要释放的内存)，
+                    // 记录仍然按照水位线及归并顺序写入文件，之后到达的更早时间的记录不会因为内存压力而乱序
+                    share := (shortage*buffer.Memory() + used - 1)/used
+                    bufferBudget.release(buffer.Spill(share))
                 }
+                // 日志时间不晚于水位线的记录一次性全部写入
+                maxTime := buffer.Watermark()
+                saveBufferItems(path, buffer.PopUntil(maxTime), buffer, maxTime)
             } else {
                 //glog.Debugfln("%s empty array", path)
             }
+            setBufferLength(path, buffer.Len())
         }(key)
     }
 }
 
+// 写入所有缓冲区中的全部日志记录，等待正在进行的写入任务完成(输出文件转移给其他副本写入之前调用)
+func flushAllBuffers() {
+    for _, path := range bufferMap.Keys() {
+        gmlock.Lock(path)
+        buffer := bufferMap.Get(path).(*mergeBuffer)
+        saveBufferItems(path, buffer.PopAll(), buffer, gtime.Millisecond())
+        gmlock.Unlock(path)
+    }
+}
+
+// 写入从缓冲区中取出的日志记录，写入成功之后标记日志记录处理完成
+func saveBufferItems(path string, items []*bufferItem, buffer *mergeBuffer, maxTime int64) {
+    if len(items) == 0 {
+        return
+    }
+    // 记录正在写入的文件，用于健康检查
+    start := gtime.Millisecond()
+    writingMap.Set(path, int(gtime.Second()))
+    defer func() {
+        writingMap.Remove(path)
+        observeFlushLatency(start)
+    }()
+    // 读取已写入磁盘的记录内容
+    loadSpilledItems(items)
+    lateItems   := make([]*bufferItem, 0)
+    inTimeItems := make([]*bufferItem, 0, len(items))
+    bufferSize  := 0
+    ranges      := make([]*recordRange, 0)
+    for _, item := range items {
+        bufferSize += len(item.content)
+        if item.rng != nil {
+            ranges = append(ranges, item.rng)
+        }
+        if item.late {
+            lateItems = append(lateItems, item)
+        } else {
+            inTimeItems = append(inTimeItems, item)
+        }
+    }
+    // 按照时间分段写入文件，写入失败时会阻塞重试直到成功
+    writeSegments(path, inTimeItems)
+    writeSegments(path + LATE_FILE_EXT, lateItems)
+    // 真实写入成功之后才记录已写入的字节范围，并标记日志记录处理完成(推进kafka offset)，以便磁盘化
+    markWrittenRanges(ranges)
+    for _, item := range items {
+        item.unit.done()
+    }
+    bufferBudget.releaseItems(items)
+    releaseSpilledItems(items)
+    glog.Debugfln("%s : %d, %d, %d, %s, %s", path, bufferSize, len(items), buffer.Len(),
+        gtime.NewFromTimeStamp(items[0].mtime).Format("Y-m-d H:i:s.u"),
+        gtime.NewFromTimeStamp(maxTime).Format("Y-m-d H:i:s.u"),
+    )
+}
+
 // 导出topic offset到磁盘保存
 func handlerDumpOffsetMapCron() {
     if !dryrun {
+        dumpDedupWindows()
         topicMap.RLockFunc(func(m map[string]interface{}) {
-            for _, v := range m {
-                go dumpOffsetMap(v.(*gmap.StringIntMap))
+            for k, v := range m {
+                go dumpOffsetMap(k, v.(*gmap.StringIntMap))
             }
         })
     }
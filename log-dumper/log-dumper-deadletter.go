@@ -0,0 +1,90 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/Shopify/sarama"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gkafka"
+    "k8s-log/internal/deadletter"
+    "strings"
+    "sync"
+)
+
+var (
+    // 死信kafka生产者(设置DEAD_LETTER_TOPIC时使用)
+    deadLetterProducer     sarama.SyncProducer
+    deadLetterProducerOnce sync.Once
+)
+
+// 写入死信记录，设置DEAD_LETTER_TOPIC时写入kafka，否则(或者写入kafka失败时)写入死信目录
+func writeDeadLetter(kafkaMsg *gkafka.Message, reason string, packages [][]byte) {
+    addDeadLetter(kafkaMsg.Topic, reason)
+    letter := &deadletter.DeadLetter {
+        Time      : gtime.Datetime(),
+        Reason    : reason,
+        Topic     : kafkaMsg.Topic,
+        Partition : kafkaMsg.Partition,
+        Offset    : kafkaMsg.Offset,
+        Key       : kafkaMsg.Key,
+        Packages  : packages,
+    }
+    glog.Errorfln("dead letter - topic: %s, partition: %d, offset: %d, reason: %s", letter.Topic, letter.Partition, letter.Offset, reason)
+    if dryrun {
+        return
+    }
+    content, err := json.Marshal(letter)
+    if err != nil {
+        glog.Error(err)
+        return
+    }
+    if deadLetterTopic != "" {
+        if err = sendDeadLetter(kafkaMsg, content); err == nil {
+            return
+        }
+        glog.Error(err)
+    }
+    path := fmt.Sprintf("%s/%s/%s/%s.jsonl", logPath, DEAD_LETTER_DIR_NAME, kafkaMsg.Topic, gtime.Date())
+    if err := gfile.PutBinContentsAppend(path, append(content, '\n')); err != nil {
+        glog.Error(err)
+    }
+}
+
+// 发送死信记录到DEAD_LETTER_TOPIC
+func sendDeadLetter(kafkaMsg *gkafka.Message, content []byte) error {
+    deadLetterProducerOnce.Do(func() {
+        config := sarama.NewConfig()
+        config.Producer.Return.Successes = true
+        config.Producer.RequiredAcks     = sarama.WaitForAll
+        if err := kafkaAuth.Apply(config); err != nil {
+            glog.Error(err)
+            return
+        }
+        if p, err := sarama.NewSyncProducer(strings.Split(kafkaAddr, ","), config); err != nil {
+            glog.Error(err)
+        } else {
+            deadLetterProducer = p
+        }
+    })
+    if deadLetterProducer == nil {
+        return fmt.Errorf("dead letter producer unavailable")
+    }
+    _, _, err := deadLetterProducer.SendMessage(&sarama.ProducerMessage {
+        Topic : deadLetterTopic,
+        Key   : sarama.ByteEncoder(kafkaMsg.Key),
+        Value : sarama.ByteEncoder(content),
+    })
+    return err
+}
+
+// 定时检查超过PACKAGE_TIMEOUT仍未组装完成的分包消息，写入死信并提交已到达分包的offset
+func checkPendingPackageCron() {
+    for _, entry := range packageStore.expire() {
+        parts, _ := packageStore.release(entry)
+        addReassemblyTimeout(entry.kafkaMsg.Topic)
+        writeDeadLetter(entry.kafkaMsg, fmt.Sprintf("incomplete package: %d", entry.id), encodePackages(entry.id, entry.total, parts))
+        doneOffsetRefs(entry.refs)
+    }
+}
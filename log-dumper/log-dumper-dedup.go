@@ -0,0 +1,291 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gkafka"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// 日志记录在源文件中的字节范围[Start, End)
+type byteRange struct {
+    Start int64 `json:"start"`
+    End   int64 `json:"end"`
+}
+
+// 日志记录的来源信息，用于写入成功后记录已写入的字节范围
+type recordRange struct {
+    key string // 源文件标识: 主机名称 + 日志文件路径 + 文件标识
+    byteRange
+}
+
+// 单个源文件已处理的字节范围窗口，范围按照起始位置排序并合并，超过数量限制时丢弃最小的范围
+type dedupWindow struct {
+    mu      sync.Mutex
+    Ranges  []byteRange `json:"ranges"`
+    Updated int64       `json:"updated"` // 最后更新时间(秒)
+}
+
+var (
+    // 已接收(包括缓冲区中未写入)的字节范围，用于过滤客户端重发的日志记录
+    receivedWindowMap = gmap.NewStringInterfaceMap()
+    // 已写入文件的字节范围，持久化保存，转储端重启后重新消费的日志记录不会重复写入
+    writtenWindowMap  = gmap.NewStringInterfaceMap()
+    // 保证保存、移除字节范围窗口文件的操作互斥，横向扩展模式下已交给其他副本的窗口文件不会被旧内容覆盖
+    dedupFileMu       sync.Mutex
+)
+
+// 生成源文件标识，scope为字节范围窗口的保存范围(横向扩展模式下为ROUTE_TOPIC的partition，否则为空)
+func getDedupKey(msg *Message, scope string) string {
+    key := fmt.Sprintf("%s:%s:%d", msg.Host, msg.Path, msg.Epoch)
+    if scope != "" {
+        return scope + "|" + key
+    }
+    return key
+}
+
+// 横向扩展模式下ROUTE_TOPIC partition对应的字节范围窗口保存范围
+func getRouteDedupScope(partition int32) string {
+    return fmt.Sprintf("route-%d", partition)
+}
+
+// 源文件标识所属的保存范围
+func getDedupScope(key string) string {
+    if scaleMode != SCALE_MODE_ROUTE {
+        return ""
+    }
+    if i := strings.Index(key, "|"); i > 0 {
+        return key[ : i]
+    }
+    return ""
+}
+
+// 获取源文件的字节范围窗口
+func getDedupWindow(m *gmap.StringInterfaceMap, key string) *dedupWindow {
+    return m.GetOrSetFuncLock(key, func() interface{} {
+        return &dedupWindow{Ranges : make([]byteRange, 0)}
+    }).(*dedupWindow)
+}
+
+// 判断字节范围是否已完全处理过
+func (w *dedupWindow) contains(r byteRange) bool {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if r.End <= r.Start {
+        return false
+    }
+    i := sort.Search(len(w.Ranges), func(i int) bool { return w.Ranges[i].End >= r.End })
+    return i < len(w.Ranges) && w.Ranges[i].Start <= r.Start
+}
+
+// 添加字节范围，并与相邻或者重叠的范围合并
+func (w *dedupWindow) add(r byteRange) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    w.Updated = gtime.Second()
+    if r.End <= r.Start {
+        return
+    }
+    i := sort.Search(len(w.Ranges), func(i int) bool { return w.Ranges[i].End >= r.Start })
+    j := i
+    for j < len(w.Ranges) && w.Ranges[j].Start <= r.End {
+        if w.Ranges[j].Start < r.Start {
+            r.Start = w.Ranges[j].Start
+        }
+        if w.Ranges[j].End > r.End {
+            r.End = w.Ranges[j].End
+        }
+        j++
+    }
+    ranges := append(make([]byteRange, 0, len(w.Ranges) - (j - i) + 1), w.Ranges[ : i]...)
+    ranges  = append(ranges, r)
+    ranges  = append(ranges, w.Ranges[j : ]...)
+    if len(ranges) > dedupMaxRanges {
+        ranges = ranges[len(ranges) - dedupMaxRanges : ]
+    }
+    w.Ranges = ranges
+}
+
+// 过滤消息中已处理过的日志记录，返回剩余日志记录的字节范围(与msg.Msgs一一对应)。
+// 不带有字节范围的消息(旧版本客户端)不进行过滤，返回nil。
+func dedupMessage(msg *Message, kafkaMsg *gkafka.Message, scope string) []*recordRange {
+    if msg.Epoch == 0 || len(msg.Ends) != len(msg.Msgs) {
+        return nil
+    }
+    key    := getDedupKey(msg, scope)
+    window := getDedupWindow(receivedWindowMap, key)
+    msgs   := make([]string, 0, len(msg.Msgs))
+    ranges := make([]*recordRange, 0, len(msg.Msgs))
+    start  := msg.Start
+    for i, content := range msg.Msgs {
+        r := byteRange{Start : start, End : msg.Ends[i]}
+        start = msg.Ends[i]
+        if window.contains(r) {
+            addDuplicateRecord(kafkaMsg.Topic, len(content))
+            continue
+        }
+        window.add(r)
+        msgs   = append(msgs, content)
+        ranges = append(ranges, &recordRange{key : key, byteRange : r})
+    }
+    if len(msgs) < len(msg.Msgs) {
+        glog.Debugfln("%s: %d duplicate records dropped", key, len(msg.Msgs) - len(msgs))
+    }
+    msg.Msgs = msgs
+    return ranges
+}
+
+// 日志记录写入文件成功后记录已写入的字节范围
+func markWrittenRanges(ranges []*recordRange) {
+    for _, r := range ranges {
+        getDedupWindow(writtenWindowMap, r.key).add(r.byteRange)
+    }
+}
+
+// 字节范围窗口持久化文件路径，横向扩展模式下每个ROUTE_TOPIC partition使用单独的文件，
+// partition重新分配后由新的副本从日志目录中读取
+func dedupFilePath(scope string) string {
+    if scope != "" {
+        return fmt.Sprintf("%s/%s/windows.%s.json", logPath, KAFKA_OFFSETS_DIR_NAME, scope)
+    }
+    return fmt.Sprintf("%s/%s/windows.json", logPath, KAFKA_OFFSETS_DIR_NAME)
+}
+
+// 初始化字节范围窗口，横向扩展模式下在分配到ROUTE_TOPIC partition时再加载
+func initDedupWindows() {
+    if scaleMode == SCALE_MODE_ROUTE {
+        return
+    }
+    loadDedupWindows("")
+}
+
+// 加载保存范围内已写入的字节范围窗口，已写入的范围同时作为已接收的范围
+func loadDedupWindows(scope string) {
+    path := dedupFilePath(scope)
+    if !gfile.Exists(path) {
+        return
+    }
+    windows := make(map[string]*dedupWindow)
+    if err := json.Unmarshal(gfile.GetBinContents(path), &windows); err != nil {
+        glog.Error(err)
+        return
+    }
+    for key, w := range windows {
+        writtenWindowMap.Set(key, w)
+        receivedWindowMap.Set(key, &dedupWindow{
+            Ranges  : append(make([]byteRange, 0, len(w.Ranges)), w.Ranges...),
+            Updated : w.Updated,
+        })
+    }
+}
+
+// 保存已写入的字节范围窗口，需要在保存kafka offset之前执行，
+// 保证已保存offset之前写入的日志记录在重新消费时都能被过滤
+func dumpDedupWindows() {
+    if dryrun {
+        return
+    }
+    dedupFileMu.Lock()
+    defer dedupFileMu.Unlock()
+    scopes := make(map[string]map[string]*dedupWindow)
+    for _, key := range writtenWindowMap.Keys() {
+        scope := getDedupScope(key)
+        if scopes[scope] == nil {
+            scopes[scope] = make(map[string]*dedupWindow)
+        }
+        if w, ok := writtenWindowMap.Get(key).(*dedupWindow); ok {
+            w.mu.Lock()
+            scopes[scope][key] = &dedupWindow{
+                Ranges  : append(make([]byteRange, 0, len(w.Ranges)), w.Ranges...),
+                Updated : w.Updated,
+            }
+            w.mu.Unlock()
+        }
+    }
+    for scope, windows := range scopes {
+        saveDedupWindows(scope, windows)
+    }
+}
+
+// 保存并移除保存范围内的字节范围窗口(横向扩展模式下ROUTE_TOPIC partition交给其他副本之前执行)
+func releaseDedupWindows(scope string) {
+    dedupFileMu.Lock()
+    defer dedupFileMu.Unlock()
+    prefix  := scope + "|"
+    windows := make(map[string]*dedupWindow)
+    for _, key := range writtenWindowMap.Keys() {
+        if !strings.HasPrefix(key, prefix) {
+            continue
+        }
+        if w, ok := writtenWindowMap.Get(key).(*dedupWindow); ok {
+            w.mu.Lock()
+            windows[key] = &dedupWindow{
+                Ranges  : append(make([]byteRange, 0, len(w.Ranges)), w.Ranges...),
+                Updated : w.Updated,
+            }
+            w.mu.Unlock()
+        }
+    }
+    if !dryrun && len(windows) > 0 {
+        saveDedupWindows(scope, windows)
+    }
+    for _, m := range []*gmap.StringInterfaceMap{receivedWindowMap, writtenWindowMap} {
+        for _, key := range m.Keys() {
+            if strings.HasPrefix(key, prefix) {
+                m.Remove(key)
+            }
+        }
+    }
+}
+
+// 写入保存范围的字节范围窗口文件
+func saveDedupWindows(scope string, windows map[string]*dedupWindow) {
+    content, err := json.Marshal(windows)
+    if err != nil {
+        glog.Error(err)
+        return
+    }
+    // 先写临时文件再重命名，防止写入过程中崩溃导致文件损坏
+    path := dedupFilePath(scope)
+    if err := gfile.PutBinContents(path + ".tmp", content); err != nil {
+        glog.Error(err)
+        return
+    }
+    if err := os.Rename(path + ".tmp", path); err != nil {
+        glog.Error(err)
+    }
+}
+
+// 清理过期的字节范围窗口，并将窗口数量限制在DEDUP_MAX_STREAMS以内(优先清理最久未更新的窗口)
+func cleanDedupWindowCron() {
+    for _, m := range []*gmap.StringInterfaceMap{receivedWindowMap, writtenWindowMap} {
+        now     := gtime.Second()
+        keys    := m.Keys()
+        updated := make(map[string]int64, len(keys))
+        for _, key := range keys {
+            if w, ok := m.Get(key).(*dedupWindow); ok {
+                w.mu.Lock()
+                updated[key] = w.Updated
+                w.mu.Unlock()
+            }
+            if now - updated[key] > dedupTtl {
+                m.Remove(key)
+            }
+        }
+        if m.Size() <= dedupMaxStreams {
+            continue
+        }
+        keys = m.Keys()
+        sort.Slice(keys, func(i, j int) bool { return updated[keys[i]] < updated[keys[j]] })
+        for _, key := range keys[ : len(keys) - dedupMaxStreams] {
+            m.Remove(key)
+        }
+    }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "github.com/gogf/gkafka"
+    "io/ioutil"
+    "os"
+    "reflect"
+    "testing"
+)
+
+// 相邻或者重叠的范围合并为一个范围，只有完全落在已有范围内的范围才视为已处理
+func TestDedupWindowAddContains(t *testing.T) {
+    w := &dedupWindow{Ranges : make([]byteRange, 0)}
+    w.add(byteRange{Start : 10, End : 20})
+    w.add(byteRange{Start : 30, End : 40})
+    w.add(byteRange{Start : 20, End : 25})
+    w.add(byteRange{Start : 38, End : 50})
+    expected := []byteRange{{Start : 10, End : 25}, {Start : 30, End : 50}}
+    if !reflect.DeepEqual(w.Ranges, expected) {
+        t.Fatalf("ranges %v, want %v", w.Ranges, expected)
+    }
+    for r, contained := range map[byteRange]bool {
+        {Start : 10, End : 25} : true,
+        {Start : 12, End : 18} : true,
+        {Start : 30, End : 50} : true,
+        {Start : 20, End : 31} : false,
+        {Start : 45, End : 51} : false,
+        {Start : 0,  End : 5}  : false,
+        {Start : 15, End : 15} : false,
+    } {
+        if w.contains(r) != contained {
+            t.Fatalf("contains(%v) = %v, want %v", r, !contained, contained)
+        }
+    }
+}
+
+// 超过DEDUP_MAX_RANGES时丢弃起始位置最小的范围
+func TestDedupWindowMaxRanges(t *testing.T) {
+    defer func(n int) {
+        dedupMaxRanges = n
+    }(dedupMaxRanges)
+    dedupMaxRanges = 2
+    w := &dedupWindow{Ranges : make([]byteRange, 0)}
+    for _, start := range []int64{0, 10, 20} {
+        w.add(byteRange{Start : start, End : start + 5})
+    }
+    expected := []byteRange{{Start : 10, End : 15}, {Start : 20, End : 25}}
+    if !reflect.DeepEqual(w.Ranges, expected) {
+        t.Fatalf("ranges %v, want %v", w.Ranges, expected)
+    }
+}
+
+// 生成测试消息，ends为每条记录的结束位置
+func newDedupTestMessage(path string, start int64, ends ...int64) *Message {
+    msg := &Message {
+        Path  : path,
+        Host  : "node-a",
+        Epoch : 1,
+        Start : start,
+        Ends  : ends,
+        Msgs  : make([]string, len(ends)),
+    }
+    for i := range ends {
+        msg.Msgs[i] = "record\n"
+    }
+    return msg
+}
+
+// 重发的消息中已接收的日志记录被过滤，部分重叠时只保留未接收的记录
+func TestDedupMessageFiltersResent(t *testing.T) {
+    kafkaMsg := &gkafka.Message{Topic : "dedup"}
+    path     := "/test/dedup-resent.log"
+    if ranges := dedupMessage(newDedupTestMessage(path, 0, 10, 20), kafkaMsg, ""); len(ranges) != 2 {
+        t.Fatalf("first message kept %d records, want 2", len(ranges))
+    }
+    msg    := newDedupTestMessage(path, 10, 20, 30)
+    ranges := dedupMessage(msg, kafkaMsg, "")
+    if len(ranges) != 1 || len(msg.Msgs) != 1 || ranges[0].byteRange != (byteRange{Start : 20, End : 30}) {
+        t.Fatalf("resent message kept %d records %v, want [20, 30)", len(msg.Msgs), ranges)
+    }
+    // 不带有字节范围的消息(旧版本客户端)不进行过滤
+    old := newDedupTestMessage(path, 0, 10)
+    old.Epoch = 0
+    if ranges := dedupMessage(old, kafkaMsg, ""); ranges != nil || len(old.Msgs) != 1 {
+        t.Fatal("message without byte ranges filtered")
+    }
+}
+
+// 已写入的字节范围持久化保存，重启后重新消费的日志记录被过滤，只接收未写入的记录不会被保存
+func TestDedupWindowsPersist(t *testing.T) {
+    dir, err := ioutil.TempDir("", "dumper-dedup")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    defer func(path string) {
+        logPath = path
+    }(logPath)
+    logPath   = dir
+    kafkaMsg := &gkafka.Message{Topic : "dedup"}
+    path     := "/test/dedup-persist.log"
+    ranges   := dedupMessage(newDedupTestMessage(path, 0, 10, 20, 30), kafkaMsg, "")
+    markWrittenRanges(ranges[ : 2])
+    dumpDedupWindows()
+    receivedWindowMap.Clear()
+    writtenWindowMap.Clear()
+    loadDedupWindows("")
+    msg := newDedupTestMessage(path, 0, 10, 20, 30)
+    if ranges := dedupMessage(msg, kafkaMsg, ""); len(ranges) != 1 || ranges[0].byteRange != (byteRange{Start : 20, End : 30}) {
+        t.Fatalf("kept %v after restart, want only the unwritten record [20, 30)", ranges)
+    }
+}
+
+// 清理过期的窗口，并将窗口数量限制在DEDUP_MAX_STREAMS以内
+func TestCleanDedupWindowCron(t *testing.T) {
+    defer func(n int, ttl int64) {
+        dedupMaxStreams = n
+        dedupTtl        = ttl
+    }(dedupMaxStreams, dedupTtl)
+    dedupMaxStreams = 2
+    dedupTtl        = 60
+    receivedWindowMap.Clear()
+    writtenWindowMap.Clear()
+    kafkaMsg := &gkafka.Message{Topic : "dedup"}
+    for _, path := range []string{"/test/a.log", "/test/b.log", "/test/c.log", "/test/d.log"} {
+        dedupMessage(newDedupTestMessage(path, 0, 10), kafkaMsg, "")
+    }
+    // a已过期，b最久未更新
+    getDedupWindow(receivedWindowMap, "node-a:/test/a.log:1").Updated -= 120
+    getDedupWindow(receivedWindowMap, "node-a:/test/b.log:1").Updated -= 30
+    cleanDedupWindowCron()
+    keys := receivedWindowMap.Keys()
+    if len(keys) != 2 || receivedWindowMap.Contains("node-a:/test/a.log:1") || receivedWindowMap.Contains("node-a:/test/b.log:1") {
+        t.Fatalf("windows %v left, want c and d", keys)
+    }
+}
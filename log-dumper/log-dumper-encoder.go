@@ -0,0 +1,72 @@
+package main
+
+import (
+    "encoding/json"
+    "github.com/gogf/gf/g/os/glog"
+    "strings"
+    "time"
+)
+
+const (
+    OUTPUT_FORMAT_RAW    = "raw"    // 原始日志内容
+    OUTPUT_FORMAT_PREFIX = "prefix" // 原始日志内容，每条记录前添加[节点主机名称/pod名称]前缀
+    OUTPUT_FORMAT_JSON   = "json"   // 每条记录一行JSON，包含日志时间、来源及kafka信息
+)
+
+// 日志记录所属消息的来源信息，同一消息的记录共用
+type recordMeta struct {
+    host      string // 节点主机名称
+    namespace string // pod所在的namespace
+    pod       string // pod名称
+    container string // 日志卷名称
+    path      string // 原始日志文件路径
+    time      string // 客户端搜集时间
+}
+
+// JSON格式的输出记录
+type jsonRecord struct {
+    Time      string `json:"time"`                // 日志时间
+    Host      string `json:"host"`                // 节点主机名称
+    Namespace string `json:"namespace,omitempty"` // pod所在的namespace
+    Pod       string `json:"pod,omitempty"`       // pod名称
+    Container string `json:"container,omitempty"` // 日志卷名称
+    Path      string `json:"path"`                // 原始日志文件路径
+    Collected string `json:"collected"`           // 客户端搜集时间
+    Topic     string `json:"topic"`               // kafka topic
+    Partition int    `json:"partition"`           // kafka partition
+    Offset    int    `json:"offset"`              // kafka offset
+    Message   string `json:"message"`             // 日志内容(不包含结尾的换行符)
+}
+
+// 按照OUTPUT_FORMAT编码日志记录
+func encodeRecord(item *bufferItem) string {
+    switch outputFormat {
+    case OUTPUT_FORMAT_PREFIX:
+        prefix := item.meta.host
+        if item.meta.pod != "" {
+            prefix += "/" + item.meta.pod
+        }
+        return "[" + prefix + "] " + item.content
+
+    case OUTPUT_FORMAT_JSON:
+        content, err := json.Marshal(&jsonRecord {
+            Time      : time.Unix(0, item.mtime*int64(time.Millisecond)).Format("2006-01-02T15:04:05.000Z07:00"),
+            Host      : item.meta.host,
+            Namespace : item.meta.namespace,
+            Pod       : item.meta.pod,
+            Container : item.meta.container,
+            Path      : item.meta.path,
+            Collected : item.meta.time,
+            Topic     : item.topic,
+            Partition : item.partition,
+            Offset    : item.offset,
+            Message   : strings.TrimRight(item.content, "\r\n"),
+        })
+        if err != nil {
+            glog.Error(err)
+            return item.content
+        }
+        return string(content) + "\n"
+    }
+    return item.content
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "bufio"
+    "container/list"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "os"
+    "sync"
+    "time"
+)
+
+const (
+    FSYNC_POLICY_NONE     = "none"     // 不主动同步，由操作系统决定写入磁盘的时机
+    FSYNC_POLICY_FLUSH    = "flush"    // 每次批量写入后同步
+    FSYNC_POLICY_INTERVAL = "interval" // 每隔FSYNC_INTERVAL秒同步有写入的文件
+)
+
+// 已打开的追加写入文件句柄
+type fileHandle struct {
+    path    string
+    file    *os.File
+    info    os.FileInfo   // 打开时的文件信息，用于判断文件是否被重命名或者删除
+    writer  *bufio.Writer
+    size    int64         // 当前文件大小
+    dirty   bool          // 是否有未同步到磁盘的写入
+    used    int64         // (毫秒)最后使用时间
+    element *list.Element // 在LRU链表中的位置
+    mu      sync.Mutex
+    closed  bool          // 是否已被关闭(从缓存中移除)
+}
+
+// 文件句柄LRU缓存，超过数量限制时关闭最久未使用的句柄
+type handleCache struct {
+    mu      sync.Mutex
+    size    int
+    lru     *list.List
+    handles map[string]*fileHandle
+}
+
+var (
+    // 输出文件句柄缓存
+    handles = newHandleCache(handleCacheSize)
+)
+
+func newHandleCache(size int) *handleCache {
+    return &handleCache {
+        size    : size,
+        lru     : list.New(),
+        handles : make(map[string]*fileHandle),
+    }
+}
+
+// 打开文件用于追加写入
+func openFileHandle(path string) (*fileHandle, error) {
+    if err := gfile.Mkdir(gfile.Dir(path)); err != nil {
+        return nil, err
+    }
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+    if err != nil {
+        return nil, err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    return &fileHandle {
+        path   : path,
+        file   : file,
+        info   : info,
+        writer : bufio.NewWriterSize(file, writeBufferSize),
+        size   : info.Size(),
+    }, nil
+}
+
+// 写入内容到缓冲区，返回写入的字节数
+func (h *fileHandle) write(content []byte) (int, error) {
+    n, err := h.writer.Write(content)
+    h.dirty = true
+    return n, err
+}
+
+// 将缓冲区内容写入文件，按照FSYNC_POLICY决定是否同步到磁盘
+func (h *fileHandle) flush() error {
+    if err := h.writer.Flush(); err != nil {
+        return err
+    }
+    if fsyncPolicy == FSYNC_POLICY_FLUSH {
+        return h.sync()
+    }
+    return nil
+}
+
+// 同步文件内容到磁盘
+func (h *fileHandle) sync() error {
+    if !h.dirty {
+        return nil
+    }
+    if err := h.file.Sync(); err != nil {
+        return err
+    }
+    h.dirty = false
+    return nil
+}
+
+// 关闭文件句柄，关闭前写入缓冲区内容
+func (h *fileHandle) close() {
+    if err := h.writer.Flush(); err != nil {
+        addWriteError("write")
+        glog.Error(h.path, err)
+    }
+    if fsyncPolicy != FSYNC_POLICY_NONE {
+        if err := h.sync(); err != nil {
+            addWriteError("sync")
+            glog.Error(h.path, err)
+        }
+    }
+    if err := h.file.Close(); err != nil {
+        addWriteError("close")
+        glog.Error(h.path, err)
+    }
+}
+
+// 判断打开的文件是否仍然是路径对应的文件(没有被外部重命名或者删除)
+func (h *fileHandle) valid() bool {
+    info, err := os.Stat(h.path)
+    return err == nil && os.SameFile(info, h.info)
+}
+
+// 获取文件句柄，文件是否被外部重命名或者删除由checkHandleCron定时检查
+func (c *handleCache) get(path string) (*fileHandle, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if h, ok := c.handles[path]; ok {
+        h.used = gtime.Millisecond()
+        c.lru.MoveToFront(h.element)
+        return h, nil
+    }
+    h, err := openFileHandle(path)
+    if err != nil {
+        return nil, err
+    }
+    h.used    = gtime.Millisecond()
+    h.element = c.lru.PushFront(h)
+    c.handles[path] = h
+    for c.lru.Len() > c.size {
+        c.remove(c.lru.Back().Value.(*fileHandle))
+    }
+    return h, nil
+}
+
+// 关闭并移除文件句柄
+func (c *handleCache) close(path string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if h, ok := c.handles[path]; ok {
+        c.remove(h)
+    }
+}
+
+// 移除指定的文件句柄(句柄可能已被其他协程替换)，关闭句柄时不持有c.mu
+func (c *handleCache) discard(h *fileHandle) {
+    c.mu.Lock()
+    if c.handles[h.path] != h {
+        c.mu.Unlock()
+        return
+    }
+    c.detach(h)
+    c.mu.Unlock()
+    h.release()
+}
+
+// 关闭并移除文件句柄，需要在持有c.mu时调用
+func (c *handleCache) remove(h *fileHandle) {
+    c.detach(h)
+    h.release()
+}
+
+// 从缓存中移除文件句柄，需要在持有c.mu时调用，移除后由调用方关闭句柄
+func (c *handleCache) detach(h *fileHandle) {
+    c.lru.Remove(h.element)
+    delete(c.handles, h.path)
+}
+
+// 关闭已从缓存中移除的文件句柄，正在使用该句柄的写入完成后关闭，之后的写入会重新获取句柄
+func (h *fileHandle) release() {
+    h.mu.Lock()
+    h.close()
+    h.closed = true
+    h.mu.Unlock()
+}
+
+// 写入内容并刷新缓冲区，返回写入后的文件大小。
+// 写入失败时关闭句柄，并根据文件大小计算已写入的内容，只重试剩余的内容，每隔1秒重试直到成功。
+func (c *handleCache) write(path string, content []byte) int64 {
+    for {
+        h, err := c.get(path)
+        if err == nil {
+            h.mu.Lock()
+            if h.closed {
+                // 句柄已被淘汰，重新获取
+                h.mu.Unlock()
+                continue
+            }
+            before := h.size
+            if _, err = h.write(content); err == nil {
+                err = h.flush()
+            }
+            if err == nil {
+                h.size += int64(len(content))
+                size := h.size
+                h.mu.Unlock()
+                return size
+            }
+            h.mu.Unlock()
+            c.discard(h)
+            if info, e := os.Stat(path); e == nil && os.SameFile(info, h.info) {
+                if written := info.Size() - before; written > 0 && written <= int64(len(content)) {
+                    content = content[written : ]
+                }
+            }
+        }
+        addWriteError("write")
+        glog.Error(path, err)
+        time.Sleep(time.Second)
+    }
+}
+
+// 定时同步有写入的文件(FSYNC_POLICY=interval)，关闭长时间未使用的文件句柄，
+// 并检查文件是否被外部重命名或者删除，变化后关闭句柄，下次写入时重新打开。
+// 只在取出句柄列表时持有缓存锁，同步及检查文件时只持有单个句柄的锁，不阻塞其他文件的写入。
+func checkHandleCron() {
+    now    := gtime.Millisecond()
+    idle   := make([]*fileHandle, 0)
+    active := make([]*fileHandle, 0)
+    handles.mu.Lock()
+    for e := handles.lru.Back(); e != nil; {
+        h    := e.Value.(*fileHandle)
+        prev := e.Prev()
+        if now - h.used > handleIdleTimeout*1000 {
+            handles.detach(h)
+            idle = append(idle, h)
+        } else {
+            active = append(active, h)
+        }
+        e = prev
+    }
+    handles.mu.Unlock()
+    for _, h := range idle {
+        h.release()
+    }
+    for _, h := range active {
+        if !h.valid() {
+            glog.Debugfln("file changed externally, reopen: %s", h.path)
+            handles.discard(h)
+            continue
+        }
+        if fsyncPolicy == FSYNC_POLICY_INTERVAL {
+            h.mu.Lock()
+            if !h.closed {
+                if err := h.sync(); err != nil {
+                    addWriteError("sync")
+                    glog.Error(h.path, err)
+                }
+            }
+            h.mu.Unlock()
+        }
+    }
+}
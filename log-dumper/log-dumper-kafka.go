@@ -2,18 +2,24 @@ package main
 
 import (
     "bytes"
-    "errors"
     "fmt"
     "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/container/gtype"
     "github.com/gogf/gkafka"
     "github.com/gogf/gf/g/encoding/gjson"
     "github.com/gogf/gf/g/os/glog"
-    "github.com/gogf/gf/g/os/gtime"
     "github.com/gogf/gf/g/util/gconv"
     "github.com/gogf/gf/g/text/gregex"
-    "time"
+    "hash/fnv"
+    "sync"
 )
 
+// 待处理的kafka消息
+type kafkaTask struct {
+    msg *gkafka.Message
+    ref *offsetRef
+}
+
 // 创建kafka客户端
 func newKafkaClient(topic ... string) *gkafka.Client {
     if kafkaAddr == "" {
@@ -29,20 +35,25 @@ func newKafkaClient(topic ... string) *gkafka.Client {
     if len(topic) > 0 {
         kafkaConfig.Topics = topic[0]
     }
+    if err := kafkaAuth.Apply(&kafkaConfig.Config); err != nil {
+        panic(err)
+    }
     return gkafka.NewClient(kafkaConfig)
 }
 
 
-// 异步处理topic日志内容
-func handlerKafkaTopic(topic string) {
-    kafkaClient := newKafkaClient(topic)
+// 处理topic日志内容，直到接收消息出错或者消费端被停止，offsetMap为topic已处理的offset
+func handlerKafkaTopic(c *topicConsumer, offsetMap *gmap.StringIntMap) error {
+    topic       := c.topic
+    kafkaClient := c.connect()
+    if kafkaClient == nil {
+        return nil
+    }
+    closed := gtype.NewBool()
     defer func() {
-        kafkaClient.Close()
-        topicMap.Remove(topic)
+        closed.Set(true)
+        c.disconnect()
     }()
-    // 初始化topic offset
-    offsetMap := topicMap.Get(topic).(*gmap.StringIntMap)
-    initOffsetMap(topic, offsetMap)
     // 标记kafka指定topic partition的offset
     offsetMap.RLockFunc(func(m map[string]int) {
         for k, v := range m {
@@ -55,99 +66,138 @@ func handlerKafkaTopic(topic string) {
             }
         }
     })
+    // 每个partition的offset提交记录，消息处理完成后才向kafka及offsetMap提交
+    trackers := make(map[int]*partitionTracker)
+    getTracker := func(partition int) *partitionTracker {
+        if tracker, ok := trackers[partition]; ok {
+            return tracker
+        }
+        tracker := newPartitionTracker(func(offset int) {
+            // 处理协程全部结束后废弃本次连接的提交记录，缓冲区中尚未写入的消息由下次连接从本地offset重新消费，
+            // 防止与下次连接的提交记录交替更新本地offset导致offset回退
+            if closed.Val() {
+                return
+            }
+            setOffsetMap(topic, partition, offset)
+            kafkaClient.MarkOffset(topic, partition, offset)
+        })
+        trackers[partition] = tracker
+        return tracker
+    }
+    // 所有处理协程，断开连接前等待全部结束
+    var wg sync.WaitGroup
     handlerChan := make(chan struct{}, handlerSize)
+    // 带有key的消息(同一节点的同一日志文件)分配到固定的处理协程，保证同一日志文件的消息按照顺序处理
+    workerChans := make([]chan *kafkaTask, handlerSize)
+    for i := 0; i < handlerSize; i++ {
+        workerChans[i] = make(chan *kafkaTask, handlerSize)
+        wg.Add(1)
+        go func(ch chan *kafkaTask) {
+            defer wg.Done()
+            for task := range ch {
+                handlerKafkaMessage(task.msg, task.ref)
+            }
+        }(workerChans[i])
+    }
+    // 在断开连接之前执行(defer按照后进先出的顺序执行)
+    defer func() {
+        for _, ch := range workerChans {
+            close(ch)
+        }
+        wg.Wait()
+    }()
     for {
         if msg, err := kafkaClient.Receive(); err == nil {
+            addConsumedMessage(topic, msg.Partition, len(msg.Value))
             // 记录offset
             key := fmt.Sprintf("%s.%d", topic, msg.Partition)
             if msg.Offset <= offsetMap.Get(key) {
                 msg.MarkOffset()
                 continue
             }
+            ref := getTracker(msg.Partition).begin(msg.Offset)
+            if len(msg.Key) > 0 {
+                workerChans[getWorkerIndex(msg.Key, handlerSize)] <- &kafkaTask{msg : msg, ref : ref}
+                continue
+            }
             handlerChan <- struct{}{}
+            wg.Add(1)
             go func() {
-                handlerKafkaMessage(msg)
+                defer wg.Done()
+                handlerKafkaMessage(msg, ref)
                 <- handlerChan
             }()
         } else {
-            glog.Error(err)
-            // 如果发生错误，那么退出，
-            // 下一次会重新建立连接
-            break
+            // 如果发生错误，那么退出，由消费端按照退避时间重新建立连接
+            return err
         }
     }
 }
 
-// 处理kafka消息(使用自定义的数据结构)
-func handlerKafkaMessage(kafkaMsg *gkafka.Message) (err error) {
-    defer func() {
-        if err == nil {
-            kafkaMsg.MarkOffset()
-        }
-    }()
-    // 重新组织path
+// 处理kafka消息(使用自定义的数据结构)，ref为消息在offset提交记录中的引用，
+// 消息中的日志记录全部写入文件(或者消息写入死信)后才提交offset
+func handlerKafkaMessage(kafkaMsg *gkafka.Message, ref *offsetRef) {
     pkg := &Package{}
-    if err = gjson.DecodeTo(kafkaMsg.Value, pkg); err == nil {
-        msgBuffer := bytes.NewBuffer(nil)
-        if pkg.Total > 1 {
-            if pkg.Seq < pkg.Total {
-                key := fmt.Sprintf("%d-%d", pkg.Id, pkg.Seq)
-                if pkgCache.Contains(key) {
-                    glog.Debugfln("pkg already received: %d, seq: %d, total: %d", pkg.Id, pkg.Seq, pkg.Total)
-                } else {
-                    pkgCache.Set(key, pkg.Msg, 60000)
-                }
-                return nil
-            } else {
-                start := gtime.Second()
-                for {
-                    if gtime.Second() - start > 60 {
-                        return errors.New(fmt.Sprintf("incomplete package found: %d", pkg.Id))
-                    }
-                    // 当重新进入循环后需要清除之前的msgBuffer
-                    msgBuffer.Reset()
-                    for i := 1; i <= pkg.Total; i++ {
-                        // 最后一条消息没有写缓存，这里直接write
-                        if i == pkg.Total {
-                            msgBuffer.Write(pkg.Msg)
-                            goto MsgHandle
-                        } else if v := pkgCache.Get(fmt.Sprintf("%d-%d", pkg.Id, i)); v != nil {
-                            msgBuffer.Write(v.([]byte))
-                        } else {
-                            // glog.Debugfln("waiting for pkg to complete: %d, seq: %d, total: %d", pkg.Id, pkg.Seq, pkg.Total)
-                            break
-                        }
-                    }
-                    // 如果包不完整，等待1秒后重试，最长等待1分钟
-                    time.Sleep(time.Second)
-                }
-            }
-        } else if pkg.Total == 1 {
-            msgBuffer.Write(pkg.Msg)
-        } else {
-            return errors.New(fmt.Sprintf("invalid package: %s", string(kafkaMsg.Value)))
+    if err := gjson.DecodeTo(kafkaMsg.Value, pkg); err != nil {
+        writeDeadLetter(kafkaMsg, fmt.Sprintf("invalid package: %s", err.Error()), [][]byte{kafkaMsg.Value})
+        ref.done()
+        return
+    }
+    if pkg.Total < 1 || pkg.Seq < 1 || pkg.Seq > pkg.Total {
+        writeDeadLetter(kafkaMsg, "invalid package total", [][]byte{kafkaMsg.Value})
+        ref.done()
+        return
+    }
+    refs     := []*offsetRef{ref}
+    content  := pkg.Msg
+    packages := [][]byte{kafkaMsg.Value}
+    if pkg.Total > 1 {
+        // 分包未全部到达时直接返回，由最后到达的分包继续处理，超时未组装完成的分包由checkPendingPackageCron写入死信
+        entry, duplicate := packageStore.add(kafkaMsg, pkg, ref)
+        if duplicate {
+            // 已组装完成的分包消息被重发，重复的分包直接标记完成，不阻塞offset提交
+            glog.Debugfln("duplicate pkg of completed message: %d, seq: %d, total: %d", pkg.Id, pkg.Seq, pkg.Total)
+            ref.done()
+            return
         }
-
-    MsgHandle:
-        msg := &Message{}
-        if err = gjson.DecodeTo(msgBuffer.Bytes(), msg); err != nil {
-            glog.Println(pkg.Id, ":", msgBuffer.String())
-            for i := 1; i < pkg.Total; i++ {
-                glog.Println(pkg.Id, i, ":", string(pkgCache.Get(fmt.Sprintf("%d-%d", pkg.Id, i)).([]byte)))
-            }
-            glog.Println(pkg.Id, pkg.Seq, ":", string(pkg.Msg))
-            glog.Error(err)
+        if entry == nil {
+            return
+        }
+        refs = entry.refs
+        parts, err := packageStore.release(entry)
+        packages = encodePackages(pkg.Id, pkg.Total, parts)
+        if err != nil {
+            writeDeadLetter(kafkaMsg, fmt.Sprintf("unreadable package: %s", err.Error()), packages)
+            doneOffsetRefs(refs)
+            return
         }
-        // 重新组织path
-        msg.Path, _ = gregex.ReplaceString(`.+kubernetes\.io~empty\-dir/log.*?/`, LOG_PATH + "/", msg.Path)
-        addToBufferArray(msg, kafkaMsg)
-        // 使用完毕后清理分包缓存，防止内存占用
-        for i := 1; i < pkg.Total; i++ {
-            pkgCache.Remove(fmt.Sprintf("%d-%d", pkg.Id, i))
+        buffer := bytes.NewBuffer(nil)
+        for i := 1; i <= pkg.Total; i++ {
+            buffer.Write(parts[i])
         }
-    } else {
-        glog.Error(err)
+        content = buffer.Bytes()
     }
-    return
+    msg := &Message{}
+    if err := gjson.DecodeTo(content, msg); err != nil {
+        writeDeadLetter(kafkaMsg, fmt.Sprintf("invalid message: %s", err.Error()), packages)
+        doneOffsetRefs(refs)
+        return
+    }
+    // 序列号检测需要使用原始的文件路径
+    auditMessage(msg, kafkaMsg)
+    // 横向扩展模式下按照输出路径转发给负责写入的副本，由该副本过滤重复记录
+    if scaleMode == SCALE_MODE_ROUTE {
+        routeMessage(msg, kafkaMsg, refs)
+        return
+    }
+    ranges := dedupMessage(msg, kafkaMsg, "")
+    // 按照输出路径模板写入缓冲区
+    addToBufferArray(msg, kafkaMsg, ranges, newCommitUnit(refs, len(msg.Msgs)), "")
 }
 
+// 根据消息key计算处理协程的索引
+func getWorkerIndex(key []byte, size int) int {
+    h := fnv.New32a()
+    h.Write(key)
+    return int(h.Sum32() % uint32(size))
+}
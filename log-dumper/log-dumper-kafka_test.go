@@ -0,0 +1,26 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+)
+
+// 带有相同key的消息总是分配到同一个处理协程，不同的key分散到各个处理协程
+func TestGetWorkerIndex(t *testing.T) {
+    size := 8
+    used := make(map[int]bool)
+    for i := 0; i < 100; i++ {
+        key   := []byte(fmt.Sprintf("%016x", i))
+        index := getWorkerIndex(key, size)
+        if index < 0 || index >= size {
+            t.Fatalf("worker index %d out of range [0, %d)", index, size)
+        }
+        if getWorkerIndex(key, size) != index {
+            t.Fatalf("key %s assigned to different workers", key)
+        }
+        used[index] = true
+    }
+    if len(used) != size {
+        t.Fatalf("100 keys assigned to %d of %d workers", len(used), size)
+    }
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "container/heap"
+    "github.com/gogf/gf/g/os/gtime"
+    "sync"
+)
+
+// 单个日志源(节点上的单个日志文件)在缓冲区中的记录，按照到达顺序排列
+type mergeSource struct {
+    key   string
+    items []*bufferItem
+    index int // 在堆中的位置
+}
+
+// 按照日志源的第一条记录排序的堆
+type mergeHeap []*mergeSource
+
+// 输出文件的缓冲区，对多个日志源的记录进行多路归并:
+// 1. 不同日志源之间按照(日志时间, 节点主机名称, 消息序列号, 消息内序号)排序；
+// 2. 同一日志源的记录保持原始顺序(日志时间不是单调递增时，较早时间的记录等待前面的记录写入)。
+// 写入进度由基于日志时间的水位线决定: 水位线 = 已到达的最大日志时间 - 缓冲区时间，
+// 超过缓冲区时间没有新记录到达时水位线推进到最大日志时间。
+type mergeBuffer struct {
+    mu      sync.Mutex
+    sources map[string]*mergeSource
+    heap    mergeHeap
+    length  int
+    memory  int64 // (字节)缓冲区中记录占用的内存(估计值)
+    maxTime int64 // (毫秒)已到达的最大日志时间(不超过到达时的当前时间)
+    updated int64 // (毫秒)最后添加记录的时间
+    flushed int64 // (毫秒)已写入的水位线，日志时间不晚于该时间的新记录为延迟记录
+}
+
+// 判断记录a是否排在记录b之前
+func bufferItemLess(a, b *bufferItem) bool {
+    if a.mtime != b.mtime {
+        return a.mtime < b.mtime
+    }
+    if a.meta.host != b.meta.host {
+        return a.meta.host < b.meta.host
+    }
+    if a.seq != b.seq {
+        return a.seq < b.seq
+    }
+    return a.index < b.index
+}
+
+func (h mergeHeap) Len() int {
+    return len(h)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+    return bufferItemLess(h[i].items[0], h[j].items[0])
+}
+
+func (h mergeHeap) Swap(i, j int) {
+    h[i], h[j] = h[j], h[i]
+    h[i].index = i
+    h[j].index = j
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+    source      := x.(*mergeSource)
+    source.index = len(*h)
+    *h = append(*h, source)
+}
+
+func (h *mergeHeap) Pop() interface{} {
+    old    := *h
+    source := old[len(old) - 1]
+    *h = old[ : len(old) - 1]
+    return source
+}
+
+func newMergeBuffer() *mergeBuffer {
+    return &mergeBuffer {
+        sources : make(map[string]*mergeSource),
+        heap    : make(mergeHeap, 0),
+    }
+}
+
+// 添加日志源的一条记录，同一日志源的记录需要按照原始顺序添加
+func (b *mergeBuffer) Add(key string, item *bufferItem) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    // 日志时间超过当前时间的记录(例如节点时钟偏差)不推进水位线，防止其他记录被提前写入
+    now := gtime.Millisecond()
+    if item.mtime > b.maxTime {
+        b.maxTime = item.mtime
+        if b.maxTime > now {
+            b.maxTime = now
+        }
+    }
+    b.updated = now
+    b.length++
+    b.memory += getItemMemory(item)
+    if source, ok := b.sources[key]; ok {
+        source.items = append(source.items, item)
+        return
+    }
+    source := &mergeSource {
+        key   : key,
+        items : []*bufferItem{item},
+    }
+    b.sources[key] = source
+    heap.Push(&b.heap, source)
+}
+
+// 缓冲区中的记录数量
+func (b *mergeBuffer) Len() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.length
+}
+
+// 缓冲区中记录占用的内存
+func (b *mergeBuffer) Memory() int64 {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.memory
+}
+
+// 判断日志时间是否已经早于已写入的水位线
+func (b *mergeBuffer) IsLate(mtime int64) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.flushed > 0 && mtime <= b.flushed
+}
+
+// 获取当前可写入的水位线
+func (b *mergeBuffer) Watermark() int64 {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if gtime.Millisecond() - b.updated >= bufferTime*1000 {
+        return b.maxTime
+    }
+    return b.maxTime - bufferTime*1000
+}
+
+// 按照归并顺序取出所有日志时间不晚于watermark的记录，某个日志源的第一条记录晚于watermark时，
+// 该日志源之后的记录也不会取出
+func (b *mergeBuffer) PopUntil(watermark int64) []*bufferItem {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if watermark > b.flushed {
+        b.flushed = watermark
+    }
+    items := make([]*bufferItem, 0)
+    for len(b.heap) > 0 && b.heap[0].items[0].mtime <= watermark {
+        items = append(items, b.popFront())
+    }
+    return items
+}
+
+// 按照归并顺序取出所有记录，水位线推进到已到达的最大日志时间(输出文件转移给其他副本写入之前调用)
+func (b *mergeBuffer) PopAll() []*bufferItem {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.maxTime > b.flushed {
+        b.flushed = b.maxTime
+    }
+    items := make([]*bufferItem, 0, b.length)
+    for len(b.heap) > 0 {
+        items = append(items, b.popFront())
+    }
+    return items
+}
+
+// 内存不足时将记录的内容写入磁盘，直到释放的内存不小于size，返回释放的内存大小。
+// 优先处理各日志源最后到达的记录(最晚写入文件)，记录仍然保留在原来的位置，不改变写入顺序及水位线。
+func (b *mergeBuffer) Spill(size int64) int64 {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    items := make([]*bufferItem, 0)
+    total := int64(0)
+    for _, source := range b.heap {
+        for i := len(source.items) - 1; i >= 0 && total < size; i-- {
+            if item := source.items[i]; item.spill == nil && item.content != "" {
+                items  = append(items, item)
+                total += int64(len(item.content))
+            }
+        }
+        if total >= size {
+            break
+        }
+    }
+    freed := spillItems(items)
+    b.memory -= freed
+    return freed
+}
+
+// 取出归并顺序的第一条记录，需要在加锁后调用
+func (b *mergeBuffer) popFront() *bufferItem {
+    source := b.heap[0]
+    item   := source.items[0]
+    source.items[0] = nil
+    source.items    = source.items[1 : ]
+    b.length--
+    b.memory -= getItemMemory(item)
+    if len(source.items) == 0 {
+        heap.Pop(&b.heap)
+        delete(b.sources, source.key)
+    } else {
+        heap.Fix(&b.heap, 0)
+    }
+    return item
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "math/rand"
+    "os"
+    "testing"
+)
+
+const (
+    MERGE_TEST_ROUNDS = 300 // 每个属性测试的随机轮数
+)
+
+// 测试用的日志源，items为原始顺序的记录
+type testSource struct {
+    key   string
+    items []*bufferItem
+}
+
+// 生成随机日志源: 多个节点上的多个日志文件，每条消息包含1-3条记录。
+// monotonic为true时同一日志源的日志时间单调不减，否则允许日志时间回退。
+func newTestSources(r *rand.Rand, monotonic bool) []*testSource {
+    hosts   := []string{"node-a", "node-b", "node-c"}
+    sources := make([]*testSource, r.Intn(6) + 1)
+    for i := range sources {
+        host := hosts[r.Intn(len(hosts))]
+        meta := &recordMeta{host : host}
+        src  := &testSource{key : fmt.Sprintf("%s:/var/log/app-%d.log", host, i)}
+        // 日志时间取值范围较小，使不同日志源之间经常出现相同的时间
+        mtime := int64(r.Intn(20))
+        seq   := int64(0)
+        for n := r.Intn(30); len(src.items) < n; {
+            seq++
+            count := r.Intn(3) + 1
+            for index := 0; index < count; index++ {
+                if monotonic {
+                    mtime += int64(r.Intn(3))
+                } else {
+                    mtime += int64(r.Intn(7) - 3)
+                }
+                if mtime < 0 {
+                    mtime = 0
+                }
+                src.items = append(src.items, &bufferItem {
+                    mtime   : mtime,
+                    seq     : seq,
+                    index   : index,
+                    content : fmt.Sprintf("%s#%d", src.key, len(src.items)),
+                    meta    : meta,
+                })
+            }
+        }
+        sources[i] = src
+    }
+    return sources
+}
+
+// 期望的归并顺序: (日志时间, 节点主机名称, 消息序列号, 消息内序号)，独立于bufferItemLess实现
+func mergeOrderLess(a, b *bufferItem) bool {
+    ka := fmt.Sprintf("%08d|%s|%08d|%08d", a.mtime, a.meta.host, a.seq, a.index)
+    kb := fmt.Sprintf("%08d|%s|%08d|%08d", b.mtime, b.meta.host, b.seq, b.index)
+    return ka < kb
+}
+
+// 按照各日志源的原始顺序随机交错添加到缓冲区
+func addTestSources(r *rand.Rand, buffer *mergeBuffer, sources []*testSource) {
+    next := make([]int, len(sources))
+    for {
+        pending := make([]int, 0, len(sources))
+        for i, src := range sources {
+            if next[i] < len(src.items) {
+                pending = append(pending, i)
+            }
+        }
+        if len(pending) == 0 {
+            return
+        }
+        i := pending[r.Intn(len(pending))]
+        buffer.Add(sources[i].key, sources[i].items[next[i]])
+        next[i]++
+    }
+}
+
+// 检查取出的记录: 每条记录都是其日志源剩余记录中的第一条(保持原始顺序)，
+// 并且不晚于其他日志源剩余的第一条记录(按照(日志时间, 节点主机名称, 消息序列号)归并)。
+// remaining为各日志源尚未取出的记录，检查后移除已取出的记录。
+func checkMergeOrder(t *testing.T, seed int64, output []*bufferItem, remaining map[string][]*bufferItem, keys map[*bufferItem]string) {
+    for n, item := range output {
+        key := keys[item]
+        if len(remaining[key]) == 0 || remaining[key][0] != item {
+            t.Fatalf("seed %d: item %d %s out of source order", seed, n, item.content)
+        }
+        for k, items := range remaining {
+            if k != key && len(items) > 0 && mergeOrderLess(items[0], item) {
+                t.Fatalf("seed %d: item %d %s(mtime %d) popped before %s(mtime %d)",
+                    seed, n, item.content, item.mtime, items[0].content, items[0].mtime)
+            }
+        }
+        remaining[key] = remaining[key][1 : ]
+    }
+}
+
+// 记录每个日志源尚未取出的记录及记录所属的日志源
+func indexTestSources(sources []*testSource) (map[string][]*bufferItem, map[*bufferItem]string, int) {
+    remaining := make(map[string][]*bufferItem)
+    keys      := make(map[*bufferItem]string)
+    total     := 0
+    for _, src := range sources {
+        remaining[src.key] = append([]*bufferItem{}, src.items...)
+        for _, item := range src.items {
+            keys[item] = src.key
+        }
+        total += len(src.items)
+    }
+    return remaining, keys, total
+}
+
+// 全部取出的记录按照归并顺序排列，并且保持各日志源的原始顺序
+func TestMergeBufferPopAllOrder(t *testing.T) {
+    for round := 0; round < MERGE_TEST_ROUNDS; round++ {
+        seed    := int64(round)
+        r       := rand.New(rand.NewSource(seed))
+        sources := newTestSources(r, round % 2 == 0)
+        buffer  := newMergeBuffer()
+        addTestSources(r, buffer, sources)
+        remaining, keys, total := indexTestSources(sources)
+        if buffer.Len() != total {
+            t.Fatalf("seed %d: buffer length %d, want %d", seed, buffer.Len(), total)
+        }
+        output := buffer.PopAll()
+        if len(output) != total {
+            t.Fatalf("seed %d: popped %d items, want %d", seed, len(output), total)
+        }
+        checkMergeOrder(t, seed, output, remaining, keys)
+        if buffer.Len() != 0 {
+            t.Fatalf("seed %d: %d items left after PopAll", seed, buffer.Len())
+        }
+    }
+}
+
+// 日志时间单调不减时输出按照(日志时间, 节点主机名称, 消息序列号)全局有序
+func TestMergeBufferGlobalOrder(t *testing.T) {
+    for round := 0; round < MERGE_TEST_ROUNDS; round++ {
+        seed   := int64(round)
+        r      := rand.New(rand.NewSource(seed))
+        buffer := newMergeBuffer()
+        addTestSources(r, buffer, newTestSources(r, true))
+        output := buffer.PopAll()
+        for i := 1; i < len(output); i++ {
+            a, b := output[i - 1], output[i]
+            if mergeOrderLess(b, a) {
+                t.Fatalf("seed %d: %s(%d,%s,%d) popped before %s(%d,%s,%d)", seed,
+                    a.content, a.mtime, a.meta.host, a.seq, b.content, b.mtime, b.meta.host, b.seq)
+            }
+        }
+    }
+}
+
+// 日志时间单调不减时，一次PopUntil(w)取出所有日志时间不晚于w的记录，缓冲区中不留下任何不晚于w的记录
+func TestMergeBufferPopUntil(t *testing.T) {
+    for round := 0; round < MERGE_TEST_ROUNDS; round++ {
+        seed    := int64(round)
+        r       := rand.New(rand.NewSource(seed))
+        sources := newTestSources(r, true)
+        buffer  := newMergeBuffer()
+        addTestSources(r, buffer, sources)
+        remaining, keys, total := indexTestSources(sources)
+        watermark := int64(r.Intn(60)) + 1
+        expected  := 0
+        for _, src := range sources {
+            for _, item := range src.items {
+                if item.mtime <= watermark {
+                    expected++
+                }
+            }
+        }
+        output := buffer.PopUntil(watermark)
+        if len(output) != expected {
+            t.Fatalf("seed %d: PopUntil(%d) returned %d items, want %d", seed, watermark, len(output), expected)
+        }
+        for _, item := range output {
+            if item.mtime > watermark {
+                t.Fatalf("seed %d: PopUntil(%d) returned %s with mtime %d", seed, watermark, item.content, item.mtime)
+            }
+        }
+        checkMergeOrder(t, seed, output, remaining, keys)
+        // 水位线之前的记录已经写入，之后到达的同一时间的记录为延迟记录
+        if !buffer.IsLate(watermark) || buffer.IsLate(watermark + 1) {
+            t.Fatalf("seed %d: late check mismatch after PopUntil(%d)", seed, watermark)
+        }
+        rest := buffer.PopAll()
+        if len(output) + len(rest) != total {
+            t.Fatalf("seed %d: %d + %d items, want %d", seed, len(output), len(rest), total)
+        }
+        for _, item := range rest {
+            if item.mtime <= watermark {
+                t.Fatalf("seed %d: %s with mtime %d left behind by PopUntil(%d)", seed, item.content, item.mtime, watermark)
+            }
+        }
+        checkMergeOrder(t, seed, rest, remaining, keys)
+    }
+}
+
+// 日志时间回退时，某个日志源的第一条记录晚于水位线后，该日志源之后的记录等待前面的记录写入，
+// 取出的记录正好是每个日志源在第一条晚于水位线的记录之前的部分
+func TestMergeBufferPopUntilHoldsSourceOrder(t *testing.T) {
+    for round := 0; round < MERGE_TEST_ROUNDS; round++ {
+        seed    := int64(round)
+        r       := rand.New(rand.NewSource(seed))
+        sources := newTestSources(r, false)
+        buffer  := newMergeBuffer()
+        addTestSources(r, buffer, sources)
+        remaining, keys, _ := indexTestSources(sources)
+        watermark := int64(r.Intn(40))
+        expected  := 0
+        for _, src := range sources {
+            for _, item := range src.items {
+                if item.mtime > watermark {
+                    break
+                }
+                expected++
+            }
+        }
+        output := buffer.PopUntil(watermark)
+        if len(output) != expected {
+            t.Fatalf("seed %d: PopUntil(%d) returned %d items, want %d", seed, watermark, len(output), expected)
+        }
+        checkMergeOrder(t, seed, output, remaining, keys)
+        checkMergeOrder(t, seed, buffer.PopAll(), remaining, keys)
+    }
+}
+
+// 内存预算不足时记录内容写入磁盘，之后到达的更早时间的记录仍然按照归并顺序写入，
+// 读取的内容与原始内容一致，并且不推进已写入的水位线，记录全部写入后删除磁盘文件
+func TestMergeBufferSpillKeepsOrder(t *testing.T) {
+    dir, err := ioutil.TempDir("", "buffer-spill")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    bufferSpillDir = dir
+    for round := 0; round < MERGE_TEST_ROUNDS; round++ {
+        seed    := int64(round)
+        r       := rand.New(rand.NewSource(seed))
+        sources := newTestSources(r, round % 2 == 0)
+        buffer  := newMergeBuffer()
+        remaining, keys, total := indexTestSources(sources)
+        contents := make(map[*bufferItem]string, total)
+        // 每个日志源先到达一部分记录，内存不足写入磁盘后再到达剩余的记录
+        first  := make([]*testSource, len(sources))
+        second := make([]*testSource, len(sources))
+        for i, src := range sources {
+            for _, item := range src.items {
+                contents[item] = item.content
+            }
+            cut      := r.Intn(len(src.items) + 1)
+            first[i]  = &testSource{key : src.key, items : src.items[ : cut]}
+            second[i] = &testSource{key : src.key, items : src.items[cut : ]}
+        }
+        addTestSources(r, buffer, first)
+        spillTestBuffer(t, seed, r, buffer)
+        addTestSources(r, buffer, second)
+        spillTestBuffer(t, seed, r, buffer)
+        for _, src := range sources {
+            for _, item := range src.items {
+                if buffer.IsLate(item.mtime) {
+                    t.Fatalf("seed %d: spill advanced the late watermark to %d", seed, item.mtime)
+                }
+            }
+        }
+        output := buffer.PopAll()
+        if len(output) != total {
+            t.Fatalf("seed %d: popped %d items, want %d", seed, len(output), total)
+        }
+        loadSpilledItems(output)
+        for _, item := range output {
+            if item.content != contents[item] {
+                t.Fatalf("seed %d: spilled content %q, want %q", seed, item.content, contents[item])
+            }
+        }
+        checkMergeOrder(t, seed, output, remaining, keys)
+        if buffer.Memory() != 0 {
+            t.Fatalf("seed %d: buffer memory %d after PopAll", seed, buffer.Memory())
+        }
+        releaseSpilledItems(output)
+        if files, _ := ioutil.ReadDir(dir); len(files) > 0 {
+            t.Fatalf("seed %d: %d spill files left after release", seed, len(files))
+        }
+    }
+}
+
+// 随机释放缓冲区的部分内存，检查释放的内存与缓冲区占用的内存一致
+func spillTestBuffer(t *testing.T, seed int64, r *rand.Rand, buffer *mergeBuffer) {
+    memory := buffer.Memory()
+    size   := int64(r.Intn(int(memory) + 1))
+    freed  := buffer.Spill(size)
+    if buffer.Memory() != memory - freed {
+        t.Fatalf("seed %d: buffer memory %d after spilling %d, want %d", seed, buffer.Memory(), freed, memory - freed)
+    }
+    if freed < size && buffer.Len() > 0 {
+        // 所有记录的内容都已写入磁盘时才允许释放的内存小于size
+        if buffer.Memory() != int64(buffer.Len())*BUFFER_ITEM_OVERHEAD {
+            t.Fatalf("seed %d: Spill(%d) freed only %d", seed, size, freed)
+        }
+    }
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+    "fmt"
+    "github.com/Shopify/sarama"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+var (
+    // 消息序列号检测事件数量
+    sequenceEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_sequence_events_total",
+        Help : "Number of sequence events (gap, duplicate, reorder, overlap, hole) detected per topic.",
+    }, []string{"topic", "type"})
+    // 序列号跳跃时未到达的消息数量
+    sequenceMissingCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_sequence_missing_total",
+        Help : "Number of messages found missing by sequence gaps per topic.",
+    }, []string{"topic"})
+    // 过滤的重复日志记录数量及字节数
+    duplicateRecordCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_duplicate_records_total",
+        Help : "Number of resent records dropped by byte range deduplication per topic.",
+    }, []string{"topic"})
+    duplicateByteCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_duplicate_bytes_total",
+        Help : "Bytes of resent records dropped by byte range deduplication per topic.",
+    }, []string{"topic"})
+    // 延迟记录数量
+    lateRecordCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_late_records_total",
+        Help : "Number of records arriving behind the flushed event-time watermark per topic and policy.",
+    }, []string{"topic", "policy"})
+    // 死信记录数量
+    deadLetterCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_dead_letters_total",
+        Help : "Number of undecodable or incomplete packages written to dead letters per topic and reason.",
+    }, []string{"topic", "reason"})
+    // 消费的kafka消息数量及字节数
+    consumedMessageCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_consumed_messages_total",
+        Help : "Number of kafka messages consumed per topic and partition.",
+    }, []string{"topic", "partition"})
+    consumedByteCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_consumed_bytes_total",
+        Help : "Bytes of kafka messages consumed per topic and partition.",
+    }, []string{"topic", "partition"})
+    // 超时未组装完成的分包消息数量
+    reassemblyTimeoutCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_reassembly_timeouts_total",
+        Help : "Number of fragmented packages not completed within PACKAGE_TIMEOUT per topic.",
+    }, []string{"topic"})
+    // 等待组装的分包消息数量及占用的内存
+    reassemblyEntryGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name : "log_dumper_reassembly_packages",
+        Help : "Number of fragmented packages waiting for reassembly.",
+    }, func() float64 {
+        entries, _ := packageStore.stats()
+        return float64(entries)
+    })
+    reassemblyMemoryGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name : "log_dumper_reassembly_memory_bytes",
+        Help : "Bytes of fragments held in memory for reassembly (spilled fragments excluded).",
+    }, func() float64 {
+        _, memory := packageStore.stats()
+        return float64(memory)
+    })
+    // 输出文件缓冲区中的记录数量及容量
+    bufferLengthGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name : "log_dumper_buffer_length",
+        Help : "Number of records buffered per output path (paths with empty buffers are not exported).",
+    }, []string{"path"})
+    bufferCapacityGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name : "log_dumper_buffer_capacity",
+        Help : "Maximum number of records buffered per output path (MAX_BUFFER_LENGTH_PERFILE).",
+    }, func() float64 {
+        return float64(bufferLength)
+    })
+    // 缓冲区使用的内存及内存预算
+    bufferMemoryGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name : "log_dumper_buffer_memory_bytes",
+        Help : "Estimated bytes of records held in all output path buffers.",
+    }, func() float64 {
+        return float64(bufferBudget.usage())
+    })
+    bufferMemoryLimitGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name : "log_dumper_buffer_memory_limit_bytes",
+        Help : "Global memory budget of all output path buffers (BUFFER_MAX_MEMORY).",
+    }, func() float64 {
+        return float64(bufferMaxMemory)
+    })
+    // 批量写入的耗时
+    flushLatencyHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+        Name    : "log_dumper_flush_duration_seconds",
+        Help    : "Time spent writing one batch of records to an output path, including retries.",
+        Buckets : prometheus.ExponentialBuckets(0.001, 2, 16),
+    })
+    // 输出文件写入错误数量
+    writeErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_write_errors_total",
+        Help : "Number of output file errors per operation (write, sync, close).",
+    }, []string{"op"})
+    // 消费延迟(partition最新offset与已处理offset的差值)
+    consumerLagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name : "log_dumper_consumer_lag",
+        Help : "Messages between the partition high watermark and the last processed offset.",
+    }, []string{"topic", "partition"})
+    // 获取消费延迟时kafka元数据查询失败的数量
+    consumerLagErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_consumer_lag_errors_total",
+        Help : "Number of kafka metadata errors while updating the consumer lag per topic.",
+    }, []string{"topic"})
+    // 距离上一次保存offset的时间
+    offsetDumpAgeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Name : "log_dumper_offset_dump_age_seconds",
+        Help : "Seconds since the offsets of a topic were last saved to the offset store.",
+    }, []string{"topic"})
+    // 消费端重新连接次数
+    consumerRestartCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name : "log_dumper_consumer_restarts_total",
+        Help : "Number of consumer reconnects after receive errors per topic.",
+    }, []string{"topic"})
+)
+
+func init() {
+    prometheus.MustRegister(sequenceEventCounter, sequenceMissingCounter, duplicateRecordCounter, duplicateByteCounter, lateRecordCounter, deadLetterCounter, consumerRestartCounter,
+        consumedMessageCounter, consumedByteCounter, reassemblyTimeoutCounter, reassemblyEntryGauge, reassemblyMemoryGauge,
+        bufferLengthGauge, bufferCapacityGauge, bufferMemoryGauge, bufferMemoryLimitGauge, flushLatencyHistogram, writeErrorCounter, consumerLagGauge, consumerLagErrorCounter, offsetDumpAgeGauge)
+}
+
+// 开启监控指标服务
+func startMetricsServer() {
+    if metricsAddr == "" {
+        return
+    }
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", promhttp.Handler())
+    mux.HandleFunc("/consumers", handleConsumerStatus)
+    mux.HandleFunc("/healthz", handleHealth)
+    go func() {
+        if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+            glog.Error(err)
+        }
+    }()
+}
+
+func addSequenceEvent(topic string, event string) {
+    sequenceEventCounter.WithLabelValues(topic, event).Inc()
+}
+
+func addSequenceGap(topic string, count int64) {
+    sequenceMissingCounter.WithLabelValues(topic).Add(float64(count))
+}
+
+func addDuplicateRecord(topic string, size int) {
+    duplicateRecordCounter.WithLabelValues(topic).Inc()
+    duplicateByteCounter.WithLabelValues(topic).Add(float64(size))
+}
+
+func addLateRecord(topic string, policy string) {
+    lateRecordCounter.WithLabelValues(topic, policy).Inc()
+}
+
+// 记录死信数量，原因中的详细错误信息不作为标签值
+func addDeadLetter(topic string, reason string) {
+    if i := strings.Index(reason, ":"); i > 0 {
+        reason = reason[ : i]
+    }
+    deadLetterCounter.WithLabelValues(topic, reason).Inc()
+}
+
+func addConsumerRestart(topic string) {
+    consumerRestartCounter.WithLabelValues(topic).Inc()
+}
+
+func addConsumedMessage(topic string, partition int, size int) {
+    p := strconv.Itoa(partition)
+    consumedMessageCounter.WithLabelValues(topic, p).Inc()
+    consumedByteCounter.WithLabelValues(topic, p).Add(float64(size))
+}
+
+func addReassemblyTimeout(topic string) {
+    reassemblyTimeoutCounter.WithLabelValues(topic).Inc()
+}
+
+// 记录输出文件缓冲区中的记录数量，缓冲区为空时不再输出该路径
+func setBufferLength(path string, length int) {
+    if length == 0 {
+        bufferLengthGauge.DeleteLabelValues(path)
+    } else {
+        bufferLengthGauge.WithLabelValues(path).Set(float64(length))
+    }
+}
+
+func observeFlushLatency(start int64) {
+    flushLatencyHistogram.Observe(float64(gtime.Millisecond() - start)/1000)
+}
+
+func addWriteError(op string) {
+    writeErrorCounter.WithLabelValues(op).Inc()
+}
+
+// 定时更新消费延迟及offset保存时间
+func updateConsumerLagCron() {
+    now := gtime.Second()
+    for _, topic := range topicMap.Keys() {
+        if t := offsetDumpTimeMap.Get(topic); t > 0 {
+            offsetDumpAgeGauge.WithLabelValues(topic).Set(float64(now - int64(t)))
+        }
+        offsetMap, ok := topicMap.Get(topic).(*gmap.StringIntMap)
+        if !ok {
+            continue
+        }
+        // 单个topic查询失败时继续更新其他topic
+        client, err := getMetadataClient()
+        if err != nil {
+            glog.Error(err)
+            consumerLagErrorCounter.WithLabelValues(topic).Inc()
+            continue
+        }
+        partitions, err := client.Partitions(topic)
+        if err != nil {
+            glog.Error(err)
+            consumerLagErrorCounter.WithLabelValues(topic).Inc()
+            resetMetadataClient()
+            continue
+        }
+        for _, partition := range partitions {
+            key := buildOffsetKey(topic, int(partition))
+            if !offsetMap.Contains(key) {
+                continue
+            }
+            newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+            if err != nil {
+                glog.Error(err)
+                consumerLagErrorCounter.WithLabelValues(topic).Inc()
+                continue
+            }
+            // 最新offset为下一条消息的offset
+            lag := newest - int64(offsetMap.Get(key)) - 1
+            if lag < 0 {
+                lag = 0
+            }
+            consumerLagGauge.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(lag))
+        }
+    }
+}
+
+// 健康检查，消费端长时间没有正常运行或者输出文件长时间写入未完成时返回503
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+    problems := make([]string, 0)
+    now      := gtime.Second()
+    for _, topic := range consumerMap.Keys() {
+        if c, ok := consumerMap.Get(topic).(*topicConsumer); ok {
+            status := c.status()
+            if status.State != CONSUMER_STATE_RUNNING && now - status.Since > healthStallTimeout {
+                problems = append(problems, fmt.Sprintf("consumer of topic %s is %s for %ds: %s", topic, status.State, now - status.Since, status.LastError))
+            }
+        }
+    }
+    writingMap.RLockFunc(func(m map[string]int) {
+        for path, start := range m {
+            if now - int64(start) > healthStallTimeout {
+                problems = append(problems, fmt.Sprintf("writing %s stalled for %ds", path, now - int64(start)))
+            }
+        }
+    })
+    if len(problems) > 0 {
+        sort.Strings(problems)
+        w.WriteHeader(http.StatusServiceUnavailable)
+        fmt.Fprintln(w, strings.Join(problems, "\n"))
+        return
+    }
+    fmt.Fprintln(w, "ok")
+}
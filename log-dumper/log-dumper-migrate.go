@@ -0,0 +1,56 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// 在不同的offset存储之间迁移已处理的offset，迁移时需要停止log-dumper(bolt数据库只允许一个进程打开)。
+// 用法: log-dumper migrate-offsets -from file -to bolt [-topics a,b]
+func migrateOffsets(args []string) error {
+    flags  := flag.NewFlagSet("migrate-offsets", flag.ExitOnError)
+    from   := flags.String("from", OFFSET_STORE_FILE, "source offset store: file, kafka, bolt")
+    to     := flags.String("to", "", "target offset store: file, kafka, bolt")
+    topics := flags.String("topics", "", "comma separated topics to migrate, default all topics in the source store")
+    flags.Parse(args)
+    if *to == "" || *to == *from {
+        flags.Usage()
+        return fmt.Errorf("invalid target offset store: %s", *to)
+    }
+    source, err := newOffsetStore(*from)
+    if err != nil {
+        return err
+    }
+    defer source.Close()
+    target, err := newOffsetStore(*to)
+    if err != nil {
+        return err
+    }
+    defer target.Close()
+    // 迁移时直接覆盖目标存储中的offset，kafka存储默认只向前推进，迁移较小的offset时会被忽略
+    if store, ok := target.(*kafkaOffsetStore); ok {
+        store.reset = true
+    }
+    var names []string
+    if *topics != "" {
+        names = strings.Split(*topics, ",")
+    } else if names, err = source.Topics(); err != nil {
+        return err
+    }
+    for _, topic := range names {
+        offsets, err := source.Load(topic)
+        if err != nil {
+            return fmt.Errorf("load offsets of topic %s: %s", topic, err.Error())
+        }
+        if len(offsets) == 0 {
+            continue
+        }
+        if err := target.Save(topic, offsets); err != nil {
+            return fmt.Errorf("save offsets of topic %s: %s", topic, err.Error())
+        }
+        fmt.Fprintf(os.Stdout, "%s: %d partitions migrated from %s to %s\n", topic, len(offsets), *from, *to)
+    }
+    return nil
+}
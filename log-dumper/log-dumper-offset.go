@@ -2,26 +2,110 @@ package main
 
 import (
     "fmt"
+    "github.com/Shopify/sarama"
     "github.com/gogf/gf/g/container/gmap"
-    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gmlock"
+    "github.com/gogf/gf/g/os/gtime"
     "github.com/gogf/gf/g/util/gconv"
     "github.com/gogf/gf/g/text/gregex"
+    "sort"
+    "strings"
+    "sync"
 )
 
-// 生成kafka消费offset文件路径
-func offsetFilePath(offsetKey string) string {
-    return fmt.Sprintf("%s/%s/%s.offset", logPath, KAFKA_OFFSETS_DIR_NAME, offsetKey)
+var (
+    // 已处理的kafka offset存储，在main中根据OFFSET_STORE创建
+    offsetStore    OffsetStore
+    // 最近一次保存的offset，没有变化的partition不重复保存
+    savedOffsetMap = gmap.NewStringIntMap()
+    // (秒)每个topic最近一次保存offset的时间(没有变化时同样视为已保存)
+    offsetDumpTimeMap = gmap.NewStringIntMap()
+    // 获取kafka元数据的客户端
+    metadataClient   sarama.Client
+    metadataClientMu sync.Mutex
+)
+
+// 获取kafka元数据客户端，所有topic共用
+func getMetadataClient() (sarama.Client, error) {
+    metadataClientMu.Lock()
+    defer metadataClientMu.Unlock()
+    if metadataClient != nil && !metadataClient.Closed() {
+        return metadataClient, nil
+    }
+    config := sarama.NewConfig()
+    if err := kafkaAuth.Apply(config); err != nil {
+        return nil, err
+    }
+    client, err := sarama.NewClient(strings.Split(kafkaAddr, ","), config)
+    if err != nil {
+        return nil, err
+    }
+    metadataClient = client
+    return client, nil
+}
+
+// 获取元数据出错时关闭客户端，下一次重新创建
+func resetMetadataClient() {
+    metadataClientMu.Lock()
+    defer metadataClientMu.Unlock()
+    if metadataClient != nil {
+        metadataClient.Close()
+        metadataClient = nil
+    }
 }
 
-// 初始化topic offset
+// 从kafka元数据中获取topic的所有partition
+func getTopicPartitions(topic string) ([]int, error) {
+    client, err := getMetadataClient()
+    if err != nil {
+        return nil, err
+    }
+    ids, err := client.Partitions(topic)
+    if err != nil {
+        resetMetadataClient()
+        return nil, err
+    }
+    partitions := make([]int, len(ids))
+    for i, id := range ids {
+        partitions[i] = int(id)
+    }
+    sort.Ints(partitions)
+    return partitions, nil
+}
+
+// 初始化topic offset，partition列表以kafka元数据为准
 func initOffsetMap(topic string, offsetMap *gmap.StringIntMap) {
-    for i := 0; i < 100; i++ {
-        key  := buildOffsetKey(topic, i)
-        path := offsetFilePath(key)
-        if !gfile.Exists(path) {
-            break
+    offsets, err := offsetStore.Load(topic)
+    if err != nil {
+        glog.Errorfln("cannot load offsets of topic %s: %s", topic, err.Error())
+        return
+    }
+    for partition, offset := range offsets {
+        savedOffsetMap.Set(buildOffsetKey(topic, partition), offset)
+    }
+    partitions, err := getTopicPartitions(topic)
+    if err != nil {
+        // 无法获取元数据时使用所有已保存的partition
+        glog.Errorfln("cannot get partitions of topic %s: %s", topic, err.Error())
+        for partition, offset := range offsets {
+            offsetMap.Set(buildOffsetKey(topic, partition), offset)
+        }
+        return
+    }
+    valid := make(map[int]bool, len(partitions))
+    for _, partition := range partitions {
+        valid[partition] = true
+        if offset, ok := offsets[partition]; ok {
+            offsetMap.Set(buildOffsetKey(topic, partition), offset)
+        } else {
+            glog.Debugfln("no stored offset - topic: %s, partition: %d", topic, partition)
+        }
+    }
+    for partition := range offsets {
+        if !valid[partition] {
+            glog.Errorfln("stored partition not found in metadata, ignored - topic: %s, partition: %d", topic, partition)
         }
-        offsetMap.Set(key, gconv.Int(gfile.GetContents(path)))
     }
 }
 
@@ -49,17 +133,38 @@ func setOffsetMap(topic string, partition int, offset int) {
     })
 }
 
-// 应用自定义保存当前kafka读取的offset
-func dumpOffsetMap(offsetMap *gmap.StringIntMap) {
+// 保存当前已处理的kafka offset，只保存有变化的partition
+func dumpOffsetMap(topic string, offsetMap *gmap.StringIntMap) {
     if dryrun || offsetMap.Size() == 0 {
         return
     }
+    // 同时只允许一个该topic的保存任务存在
+    lockKey := "dump-offsets:" + topic
+    if !gmlock.TryLock(lockKey) {
+        return
+    }
+    defer gmlock.Unlock(lockKey)
+    offsets := make(map[int]int)
     offsetMap.RLockFunc(func(m map[string]int) {
         for key, offset := range m {
-            if offset == 0 {
+            if offset == 0 || savedOffsetMap.Get(key) == offset {
                 continue
             }
-            gfile.PutContents(offsetFilePath(key), gconv.String(offset))
+            if t, partition := parseOffsetKey(key); t == topic {
+                offsets[partition] = offset
+            }
         }
     })
+    if len(offsets) == 0 {
+        offsetDumpTimeMap.Set(topic, int(gtime.Second()))
+        return
+    }
+    if err := offsetStore.Save(topic, offsets); err != nil {
+        glog.Error(err)
+        return
+    }
+    offsetDumpTimeMap.Set(topic, int(gtime.Second()))
+    for partition, offset := range offsets {
+        savedOffsetMap.Set(buildOffsetKey(topic, partition), offset)
+    }
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "fmt"
+    "github.com/Shopify/sarama"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gfile"
+    "io/ioutil"
+    "os"
+    "reflect"
+    "testing"
+)
+
+// 测试使用的kafka元数据客户端，只实现获取partition列表
+type testMetadataClient struct {
+    sarama.Client
+    partitions map[string][]int32
+    closed     bool
+}
+
+func (c *testMetadataClient) Partitions(topic string) ([]int32, error) {
+    if partitions, ok := c.partitions[topic]; ok {
+        return partitions, nil
+    }
+    return nil, fmt.Errorf("unknown topic: %s", topic)
+}
+
+func (c *testMetadataClient) Closed() bool {
+    return c.closed
+}
+
+func (c *testMetadataClient) Close() error {
+    c.closed = true
+    return nil
+}
+
+// 使用测试元数据客户端及临时目录下的文件存储，返回清理函数
+func setTestOffsetStore(t *testing.T, partitions map[string][]int32) (*fileOffsetStore, *testMetadataClient, func()) {
+    dir, err := ioutil.TempDir("", "dumper-offset")
+    if err != nil {
+        t.Fatal(err)
+    }
+    client := &testMetadataClient{partitions : partitions}
+    store  := &fileOffsetStore{dir : dir}
+    oldStore, oldClient := offsetStore, metadataClient
+    offsetStore    = store
+    metadataClient = client
+    return store, client, func() {
+        offsetStore    = oldStore
+        metadataClient = oldClient
+        os.RemoveAll(dir)
+    }
+}
+
+// partition列表按照元数据排序返回，获取失败时关闭客户端以便下一次重新创建
+func TestGetTopicPartitions(t *testing.T) {
+    _, client, cleanup := setTestOffsetStore(t, map[string][]int32{"shop" : {2, 0, 1}})
+    defer cleanup()
+    partitions, err := getTopicPartitions("shop")
+    if err != nil || !reflect.DeepEqual(partitions, []int{0, 1, 2}) {
+        t.Fatalf("got partitions %v, %v, want [0 1 2]", partitions, err)
+    }
+    if _, err := getTopicPartitions("missing"); err == nil {
+        t.Fatal("no error for an unknown topic")
+    }
+    if !client.closed || metadataClient != nil {
+        t.Fatal("metadata client not reset after an error")
+    }
+}
+
+// 初始化时以元数据中的partition为准，新增的partition没有offset，元数据中不存在的partition被忽略
+func TestInitOffsetMapFromMetadata(t *testing.T) {
+    store, _, cleanup := setTestOffsetStore(t, map[string][]int32{"shop" : {0, 1, 2}})
+    defer cleanup()
+    if err := store.Save("shop", map[int]int{0 : 100, 1 : 200, 5 : 500}); err != nil {
+        t.Fatal(err)
+    }
+    offsetMap := gmap.NewStringIntMap()
+    initOffsetMap("shop", offsetMap)
+    expected := map[string]int{"shop.0" : 100, "shop.1" : 200}
+    if m := offsetMap.Clone(); !reflect.DeepEqual(m, expected) {
+        t.Fatalf("offsets %v, want %v", m, expected)
+    }
+    // 无法获取元数据时使用所有已保存的partition
+    offsetMap = gmap.NewStringIntMap()
+    metadataClient.(*testMetadataClient).partitions = nil
+    initOffsetMap("shop", offsetMap)
+    if offsetMap.Size() != 3 || offsetMap.Get("shop.5") != 500 {
+        t.Fatalf("offsets %v without metadata, want all stored partitions", offsetMap.Clone())
+    }
+}
+
+// 只保存有变化的partition，与已保存的offset合并后写入带有版本号的topic文件
+func TestDumpOffsetMap(t *testing.T) {
+    store, _, cleanup := setTestOffsetStore(t, nil)
+    defer cleanup()
+    defer savedOffsetMap.Clear()
+    offsetMap := gmap.NewStringIntMap()
+    offsetMap.Set("dump.0", 10)
+    offsetMap.Set("dump.1", 20)
+    dumpOffsetMap("dump", offsetMap)
+    // partition 0没有变化，partition 2尚未处理任何消息(offset为0)
+    savedOffsetMap.Set("dump.1", 0)
+    offsetMap.Set("dump.1", 21)
+    offsetMap.Set("dump.2", 0)
+    dumpOffsetMap("dump", offsetMap)
+    path := store.path("dump")
+    if gfile.Exists(path + ".tmp") {
+        t.Fatal("temporary offset file left")
+    }
+    offsets, err := decodeOffsetFile(gfile.GetBinContents(path))
+    if err != nil || !reflect.DeepEqual(offsets, map[int]int{0 : 10, 1 : 21}) {
+        t.Fatalf("stored offsets %v, %v, want map[0:10 1:21]", offsets, err)
+    }
+}
+
+// 不支持的文件版本返回错误，不会被当作空的offset使用
+func TestDecodeOffsetFileVersion(t *testing.T) {
+    content, err := encodeOffsetFile("shop", map[int]int{0 : 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if offsets, err := decodeOffsetFile(content); err != nil || offsets[0] != 1 {
+        t.Fatalf("decoded %v, %v", offsets, err)
+    }
+    if _, err := decodeOffsetFile([]byte(`{"version":2,"topic":"shop","partitions":{"0":1}}`)); err == nil {
+        t.Fatal("unsupported version accepted")
+    }
+}
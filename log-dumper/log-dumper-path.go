@@ -0,0 +1,119 @@
+package main
+
+import (
+    "fmt"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gf/g/text/gregex"
+    "github.com/gogf/gkafka"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// 输出路径模板中的一段，变量段的name不为空
+type templatePart struct {
+    text string // 固定文本
+    name string // 变量名称
+}
+
+var (
+    // 解析后的输出路径模板
+    outputTemplate = parseOutputTemplate(outputPathTemplate)
+)
+
+// 解析输出路径模板，例如: {namespace}/{app}/{date}/{host}.log，
+// 支持的变量:
+// topic     : kafka topic
+// app       : 应用名称(日志卷下的第一级目录)
+// namespace : pod所在的namespace
+// pod       : pod名称
+// container : 日志卷名称
+// host      : 节点主机名称
+// file      : 原始日志文件名称
+// path      : 原始日志文件在应用目录下的相对路径(可包含多级目录)
+// date      : 日志记录的日期(Y-m-d)
+// hour      : 日志记录的小时(H)
+func parseOutputTemplate(template string) []templatePart {
+    parts := make([]templatePart, 0)
+    pos   := 0
+    for _, m := range regexp.MustCompile(`\{(\w+)\}`).FindAllStringSubmatchIndex(template, -1) {
+        name := template[m[2] : m[3]]
+        switch name {
+        case "topic", "app", "namespace", "pod", "container", "host", "file", "path", "date", "hour":
+        default:
+            panic(fmt.Sprintf("unknown variable in OUTPUT_PATH_TEMPLATE: %s", name))
+        }
+        if m[0] > pos {
+            parts = append(parts, templatePart{text : template[pos : m[0]]})
+        }
+        parts = append(parts, templatePart{name : name})
+        pos = m[1]
+    }
+    if pos < len(template) {
+        parts = append(parts, templatePart{text : template[pos : ]})
+    }
+    return parts
+}
+
+// 根据模板生成日志记录的输出文件绝对路径，t为日志记录的时间
+func buildOutputPath(msg *Message, kafkaMsg *gkafka.Message, t *gtime.Time) string {
+    app, rest := "", msg.Path
+    if match, _ := gregex.MatchString(`.+kubernetes\.io~empty\-dir/log.*?/(.+?)/(.+)`, msg.Path); len(match) > 2 {
+        app, rest = match[1], match[2]
+    }
+    buffer := make([]string, 0, len(outputTemplate))
+    for _, part := range outputTemplate {
+        switch part.name {
+        case "":
+            buffer = append(buffer, part.text)
+        case "topic":
+            buffer = append(buffer, sanitizePathValue(kafkaMsg.Topic))
+        case "app":
+            buffer = append(buffer, sanitizePathValue(app))
+        case "namespace":
+            buffer = append(buffer, sanitizePathValue(msg.Namespace))
+        case "pod":
+            buffer = append(buffer, sanitizePathValue(msg.Pod))
+        case "container":
+            buffer = append(buffer, sanitizePathValue(msg.Container))
+        case "host":
+            buffer = append(buffer, sanitizePathValue(msg.Host))
+        case "file":
+            buffer = append(buffer, sanitizePathValue(filepath.Base(rest)))
+        case "path":
+            // 多级目录逐级处理，不允许出现空目录及上级目录
+            segments := strings.Split(rest, "/")
+            for i, segment := range segments {
+                segments[i] = sanitizePathValue(segment)
+            }
+            buffer = append(buffer, strings.Join(segments, "/"))
+        case "date":
+            buffer = append(buffer, t.Format("Y-m-d"))
+        case "hour":
+            buffer = append(buffer, t.Format("H"))
+        }
+    }
+    path := filepath.Join(logPath, strings.Join(buffer, ""))
+    // 模板本身配置错误(例如包含..)时，仍然保证输出路径在日志目录下
+    if !strings.HasPrefix(path, filepath.Clean(logPath) + string(filepath.Separator)) {
+        path = filepath.Join(logPath, "_", sanitizePathValue(strings.Join(buffer, "")))
+    }
+    return path
+}
+
+// 处理模板变量的值，使其只能作为单级目录或者文件名称使用，防止通过变量值访问日志目录之外的路径
+func sanitizePathValue(value string) string {
+    value = strings.Map(func(r rune) rune {
+        if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+            return '_'
+        }
+        return r
+    }, strings.TrimSpace(value))
+    switch value {
+    case "":
+        return "unknown"
+    case ".", "..":
+        return "_"
+    }
+    return value
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gkafka"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// 使用指定的模板及日志目录生成输出路径
+func buildTestOutputPath(template string, msg *Message) string {
+    defer func(parts []templatePart, path string) {
+        outputTemplate = parts
+        logPath        = path
+    }(outputTemplate, logPath)
+    outputTemplate = parseOutputTemplate(template)
+    logPath        = "/data/logs"
+    t := gtime.NewFromTime(time.Date(2018, 11, 1, 8, 30, 0, 0, time.Local))
+    return buildOutputPath(msg, &gkafka.Message{Topic : "shop"}, t)
+}
+
+func TestSanitizePathValue(t *testing.T) {
+    cases := map[string]string {
+        "web-1"       : "web-1",
+        ""            : "unknown",
+        "  "          : "unknown",
+        "."           : "_",
+        ".."          : "_",
+        "../../etc"   : ".._.._etc",
+        "a\\b"        : "a_b",
+        "a\nb"        : "a_b",
+        " pod-1 "     : "pod-1",
+    }
+    for value, expected := range cases {
+        if v := sanitizePathValue(value); v != expected {
+            t.Fatalf("sanitizePathValue(%q) = %q, want %q", value, v, expected)
+        }
+    }
+}
+
+func TestBuildOutputPath(t *testing.T) {
+    msg := &Message {
+        Path      : "/var/lib/kubelet/pods/x/volumes/kubernetes.io~empty-dir/log/shop/api/access.log",
+        Host      : "node-a",
+        Namespace : "prod",
+        Pod       : "shop-1",
+        Container : "log",
+    }
+    cases := map[string]string {
+        "{app}/{path}"                            : "/data/logs/shop/api/access.log",
+        "{namespace}/{app}/{date}/{host}.log"     : "/data/logs/prod/shop/2018-11-01/node-a.log",
+        "{topic}/{pod}/{container}/{hour}/{file}" : "/data/logs/shop/shop-1/log/08/access.log",
+    }
+    for template, expected := range cases {
+        if path := buildTestOutputPath(template, msg); path != expected {
+            t.Fatalf("template %s built %s, want %s", template, path, expected)
+        }
+    }
+}
+
+// pod、节点主机名称等变量的值不能访问日志目录之外的路径
+func TestBuildOutputPathTraversal(t *testing.T) {
+    msg := &Message {
+        Path      : "/var/lib/kubelet/pods/x/volumes/kubernetes.io~empty-dir/log/shop/../../../../etc/passwd",
+        Host      : "..",
+        Namespace : "../../etc",
+        Pod       : "/etc/cron.d",
+    }
+    for _, template := range []string {
+        "{namespace}/{pod}/{host}.log",
+        "{app}/{path}",
+        "{host}/{file}",
+        // 模板本身包含上级目录
+        "../{namespace}",
+    } {
+        path := buildTestOutputPath(template, msg)
+        if !strings.HasPrefix(path, "/data/logs/") || filepath.Clean(path) != path {
+            t.Fatalf("template %s built %s outside the log path", template, path)
+        }
+        for _, segment := range strings.Split(path, "/") {
+            if segment == ".." {
+                t.Fatalf("template %s built %s with a parent directory", template, path)
+            }
+        }
+    }
+}
+
+func TestParseOutputTemplateUnknownVariable(t *testing.T) {
+    defer func() {
+        if recover() == nil {
+            t.Fatal("unknown template variable accepted")
+        }
+    }()
+    parseOutputTemplate("{app}/{secret}.log")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gkafka"
+    "io/ioutil"
+    "os"
+    "sync"
+    "sync/atomic"
+)
+
+// 等待组装的分包
+type fragment struct {
+    data  []byte // 分包内容，写入磁盘时为nil
+    spill string // 写入磁盘的文件路径
+    size  int
+}
+
+// 等待组装的分包消息
+type reassemblyEntry struct {
+    key       string
+    id        int64
+    total     int
+    kafkaMsg  *gkafka.Message   // 最后到达的分包(用于死信记录)
+    fragments map[int]*fragment // 已到达的分包，键名为分包序号
+    refs      []*offsetRef      // 已到达分包的offset引用
+    created   int64             // (秒)第一个分包到达时间
+}
+
+// 分包组装存储，内存中的分包总大小超过REASSEMBLY_MAX_MEMORY时，新的分包写入磁盘。
+// 分包消息组装并写入文件之前，其所有分包的offset都不会被提交，转储端重启后会重新消费并组装。
+type reassemblyStore struct {
+    mu        sync.Mutex
+    entries   map[string]*reassemblyEntry
+    completed map[string]int64 // 已组装完成的分包消息及完成时间(秒)，保留PACKAGE_TIMEOUT用于识别重发的分包
+    memory    int64            // 内存中的分包总大小
+    spillId   int64            // 磁盘文件序号
+}
+
+var (
+    // 分包组装存储
+    packageStore = newReassemblyStore()
+)
+
+func newReassemblyStore() *reassemblyStore {
+    return &reassemblyStore {
+        entries   : make(map[string]*reassemblyEntry),
+        completed : make(map[string]int64),
+    }
+}
+
+// 清理上次运行遗留的磁盘文件，这些文件已经无效(对应的分包会被重新消费)
+func cleanReassemblySpillDir() {
+    if gfile.Exists(reassemblySpillDir) {
+        if err := os.RemoveAll(reassemblySpillDir); err != nil {
+            glog.Error(err)
+        }
+    }
+}
+
+// 生成分包消息的key，带有key的消息使用消息key区分不同节点及日志文件，防止不同节点的包ID冲突
+func getPackageKey(kafkaMsg *gkafka.Message, id int64) string {
+    if len(kafkaMsg.Key) > 0 {
+        return fmt.Sprintf("%s-%d", string(kafkaMsg.Key), id)
+    }
+    return fmt.Sprintf("%d", id)
+}
+
+// 添加分包，所有分包都已到达时返回对应的分包消息(已从存储中移除)，否则返回nil。
+// 分包按照任意顺序到达都可以组装，最后到达的分包所在的协程负责后续处理，不需要阻塞等待。
+// 分包消息已经组装完成后才到达的重复分包(客户端重发)返回duplicate为true，不再创建新的等待组装的消息。
+func (s *reassemblyStore) add(kafkaMsg *gkafka.Message, pkg *Package, ref *offsetRef) (entry *reassemblyEntry, duplicate bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    key := getPackageKey(kafkaMsg, pkg.Id)
+    if _, ok := s.completed[key]; ok {
+        return nil, true
+    }
+    entry = s.entries[key]
+    if entry == nil {
+        entry = &reassemblyEntry {
+            key       : key,
+            id        : pkg.Id,
+            total     : pkg.Total,
+            fragments : make(map[int]*fragment),
+            created   : gtime.Second(),
+        }
+        s.entries[key] = entry
+    }
+    entry.kafkaMsg = kafkaMsg
+    entry.refs     = append(entry.refs, ref)
+    if _, ok := entry.fragments[pkg.Seq]; ok {
+        glog.Debugfln("pkg already received: %d, seq: %d, total: %d", pkg.Id, pkg.Seq, pkg.Total)
+        return nil, false
+    }
+    f := &fragment{data : pkg.Msg, size : len(pkg.Msg)}
+    if s.memory + int64(f.size) > reassemblyMaxMemory {
+        f.spill = fmt.Sprintf("%s/%d.fragment", reassemblySpillDir, atomic.AddInt64(&s.spillId, 1))
+        if err := gfile.PutBinContents(f.spill, f.data); err != nil {
+            // 写入磁盘失败时仍然保存在内存中
+            glog.Error(err)
+            f.spill = ""
+        } else {
+            f.data = nil
+        }
+    }
+    if f.data != nil {
+        s.memory += int64(f.size)
+    }
+    entry.fragments[pkg.Seq] = f
+    if len(entry.fragments) < entry.total {
+        return nil, false
+    }
+    delete(s.entries, key)
+    s.completed[key] = gtime.Second()
+    return entry, false
+}
+
+// 读取分包消息的所有已到达分包(按照分包序号排列)，并释放分包占用的内存及磁盘文件
+func (s *reassemblyStore) release(entry *reassemblyEntry) (parts map[int][]byte, err error) {
+    parts = make(map[int][]byte, len(entry.fragments))
+    for seq, f := range entry.fragments {
+        if f.spill == "" {
+            parts[seq] = f.data
+            s.mu.Lock()
+            s.memory -= int64(f.size)
+            s.mu.Unlock()
+            continue
+        }
+        if data, e := ioutil.ReadFile(f.spill); e != nil {
+            err = e
+        } else {
+            parts[seq] = data
+        }
+        os.Remove(f.spill)
+    }
+    entry.fragments = nil
+    return
+}
+
+// 取出超过PACKAGE_TIMEOUT仍未组装完成的分包消息，同时清理超过PACKAGE_TIMEOUT的已完成记录
+func (s *reassemblyStore) expire() []*reassemblyEntry {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    now     := gtime.Second()
+    entries := make([]*reassemblyEntry, 0)
+    for key, entry := range s.entries {
+        if now - entry.created > packageTimeout {
+            entries = append(entries, entry)
+            delete(s.entries, key)
+        }
+    }
+    for key, completed := range s.completed {
+        if now - completed > packageTimeout {
+            delete(s.completed, key)
+        }
+    }
+    return entries
+}
+
+// 等待组装的分包消息数量及内存中的分包总大小
+func (s *reassemblyStore) stats() (entries int, memory int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.entries), s.memory
+}
+
+// 将分包内容重新编码为原始消息内容(用于死信记录)
+func encodePackages(id int64, total int, parts map[int][]byte) [][]byte {
+    packages := make([][]byte, 0, len(parts))
+    for i := 1; i <= total; i++ {
+        if data, ok := parts[i]; ok {
+            if content, err := json.Marshal(&Package{Id : id, Seq : i, Total : total, Msg : data}); err == nil {
+                packages = append(packages, content)
+            }
+        }
+    }
+    return packages
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gkafka"
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+// 将内容拆分为total个分包，返回各分包(分包序号从1开始)
+func splitTestPackages(id int64, content []byte, total int) []*Package {
+    packages := make([]*Package, total)
+    size     := (len(content) + total - 1)/total
+    for i := 0; i < total; i++ {
+        start, end := i*size, (i + 1)*size
+        if end > len(content) {
+            end = len(content)
+        }
+        packages[i] = &Package{Id : id, Seq : i + 1, Total : total, Msg : content[start : end]}
+    }
+    return packages
+}
+
+// 按照seqs的顺序添加分包，返回组装完成的分包消息
+func addTestPackages(t *testing.T, s *reassemblyStore, packages []*Package, seqs ...int) *reassemblyEntry {
+    kafkaMsg := &gkafka.Message{Topic : "reassembly", Key : []byte("node-a")}
+    for i, seq := range seqs {
+        entry, duplicate := s.add(kafkaMsg, packages[seq - 1], &offsetRef{})
+        if duplicate {
+            t.Fatalf("package %d treated as duplicate", seq)
+        }
+        if (entry != nil) != (i == len(seqs) - 1) {
+            t.Fatalf("package %d completed = %v, want only the last package to complete", seq, entry != nil)
+        }
+        if entry != nil {
+            return entry
+        }
+    }
+    return nil
+}
+
+// 检查组装后的内容与原始内容相同
+func checkTestPackages(t *testing.T, s *reassemblyStore, entry *reassemblyEntry, content []byte) {
+    parts, err := s.release(entry)
+    if err != nil {
+        t.Fatal(err)
+    }
+    buffer := bytes.NewBuffer(nil)
+    for i := 1; i <= entry.total; i++ {
+        buffer.Write(parts[i])
+    }
+    if !bytes.Equal(buffer.Bytes(), content) {
+        t.Fatalf("reassembled %q, want %q", buffer.Bytes(), content)
+    }
+    if entries, memory := s.stats(); entries != 0 || memory != 0 {
+        t.Fatalf("%d entries and %d bytes left after release", entries, memory)
+    }
+}
+
+// 分包按照任意顺序到达都可以组装，最后到达的分包返回完整的分包消息
+func TestReassemblyStoreAnyOrder(t *testing.T) {
+    s        := newReassemblyStore()
+    content  := []byte(`{"path":"/var/log/app.log","msgs":["record 1\n","record 2\n"]}`)
+    packages := splitTestPackages(1, content, 4)
+    entry    := addTestPackages(t, s, packages, 3, 1, 4, 2)
+    if len(entry.refs) != 4 {
+        t.Fatalf("entry holds %d offset refs, want 4", len(entry.refs))
+    }
+    checkTestPackages(t, s, entry, content)
+}
+
+// 内存中的分包总大小超过REASSEMBLY_MAX_MEMORY时新的分包写入磁盘，释放时读取并删除磁盘文件
+func TestReassemblyStoreSpill(t *testing.T) {
+    dir, err := ioutil.TempDir("", "dumper-reassembly")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    defer func(memory int64, path string) {
+        reassemblyMaxMemory = memory
+        reassemblySpillDir  = path
+    }(reassemblyMaxMemory, reassemblySpillDir)
+    reassemblyMaxMemory = 10
+    reassemblySpillDir  = dir
+    s        := newReassemblyStore()
+    content  := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+    packages := splitTestPackages(2, content, 4)
+    entry    := addTestPackages(t, s, packages, 2, 1, 3, 4)
+    spilled  := make([]string, 0)
+    for _, f := range entry.fragments {
+        if f.spill != "" {
+            if f.data != nil || !gfile.Exists(f.spill) {
+                t.Fatalf("fragment %s not spilled to disk", f.spill)
+            }
+            spilled = append(spilled, f.spill)
+        }
+    }
+    // 只有第一个分包可以保存在内存中
+    if len(spilled) != 3 {
+        t.Fatalf("%d fragments spilled, want 3", len(spilled))
+    }
+    if _, memory := s.stats(); memory != 9 {
+        t.Fatalf("%d bytes in memory, want 9", memory)
+    }
+    checkTestPackages(t, s, entry, content)
+    for _, path := range spilled {
+        if gfile.Exists(path) {
+            t.Fatalf("spill file %s not removed", path)
+        }
+    }
+}
+
+// 组装完成前重复到达的分包不覆盖已有分包，组装完成后到达的重复分包返回duplicate，
+// 超过PACKAGE_TIMEOUT后不再保留已完成记录
+func TestReassemblyStoreDuplicate(t *testing.T) {
+    s        := newReassemblyStore()
+    kafkaMsg := &gkafka.Message{Topic : "reassembly", Key : []byte("node-a")}
+    content  := []byte("duplicate package content")
+    packages := splitTestPackages(3, content, 2)
+    if entry, duplicate := s.add(kafkaMsg, packages[0], &offsetRef{}); entry != nil || duplicate {
+        t.Fatal("first package completed the message")
+    }
+    if entry, duplicate := s.add(kafkaMsg, packages[0], &offsetRef{}); entry != nil || duplicate {
+        t.Fatal("resent package before completion completed the message")
+    }
+    entry, _ := s.add(kafkaMsg, packages[1], &offsetRef{})
+    if entry == nil || len(entry.fragments) != 2 || len(entry.refs) != 3 {
+        t.Fatal("message not completed with the resent package ref")
+    }
+    checkTestPackages(t, s, entry, content)
+    for _, pkg := range packages {
+        if entry, duplicate := s.add(kafkaMsg, pkg, &offsetRef{}); entry != nil || !duplicate {
+            t.Fatalf("package %d of a completed message not treated as duplicate", pkg.Seq)
+        }
+    }
+    // 其他节点的相同包ID不受影响
+    other := &gkafka.Message{Topic : "reassembly", Key : []byte("node-b")}
+    if _, duplicate := s.add(other, packages[0], &offsetRef{}); duplicate {
+        t.Fatal("package of another node treated as duplicate")
+    }
+    for key := range s.completed {
+        s.completed[key] -= packageTimeout + 1
+    }
+    for key := range s.entries {
+        s.entries[key].created -= packageTimeout + 1
+    }
+    if expired := s.expire(); len(expired) != 1 || len(s.completed) != 0 {
+        t.Fatalf("%d entries expired and %d completed left, want 1 and 0", len(expired), len(s.completed))
+    }
+}
+
+// 分包消息组装完成并处理之前，所有分包的offset都不会被提交
+func TestHandlerPackageCommitsAfterCompletion(t *testing.T) {
+    committed := -1
+    tracker   := newPartitionTracker(func(offset int) {
+        committed = offset
+    })
+    content, err := json.Marshal(&Message{Path : "/var/log/app.log", Msgs : []string{}, Host : "node-a"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    packages := splitTestPackages(4, content, 3)
+    handle   := func(offset int, pkg *Package) {
+        value, _ := json.Marshal(pkg)
+        handlerKafkaMessage(&gkafka.Message {
+            Topic  : "reassembly",
+            Key    : []byte("commit-node"),
+            Value  : value,
+            Offset : offset,
+        }, tracker.begin(offset))
+    }
+    handle(0, packages[2])
+    handle(1, packages[0])
+    if committed != -1 {
+        t.Fatalf("offset %d committed before the message completed", committed)
+    }
+    handle(2, packages[1])
+    if committed != 2 {
+        t.Fatalf("committed offset %d after completion, want 2", committed)
+    }
+    // 组装完成后重发的分包直接提交
+    handle(3, packages[0])
+    if committed != 3 {
+        t.Fatalf("committed offset %d after the resent package, want 3", committed)
+    }
+}
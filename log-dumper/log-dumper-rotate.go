@@ -0,0 +1,238 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gf/g/text/gregex"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    ROTATE_POLICY_NONE = "none" // 不按时间切分
+    ROTATE_POLICY_HOUR = "hour" // 按照日志记录时间每小时切分
+    ROTATE_POLICY_DAY  = "day"  // 按照日志记录时间每天切分
+    SEGMENT_DONE_EXT   = ".done" // 分段文件写入完成的标记文件后缀
+)
+
+// 输出文件的一个时间分段，分段内按照大小继续切分为多个文件:
+// <输出路径>[.<时间>][.<序号>][.gz|.zst]，序号从1开始(第一个文件不带序号)
+type segmentWriter struct {
+    mu        sync.Mutex
+    base      string   // 输出路径(模板生成的路径)
+    period    string   // 时间分段名称，不按时间切分时为空
+    periodEnd int64    // (毫秒)时间分段的结束时间，不按时间切分时为0
+    index     int      // 当前文件序号
+    path      string   // 当前文件路径，为空时表示需要重新确定
+    retired   bool     // 时间分段已结束并从segmentMap中移除，不能再写入
+}
+
+var (
+    // 正在写入的分段，键名为输出路径及时间分段名称
+    segmentMap = gmap.NewStringInterfaceMap()
+)
+
+// 根据日志记录时间获取时间分段名称及分段结束时间(毫秒)
+func getSegmentPeriod(mtime int64) (string, int64) {
+    t := gtime.NewFromTimeStamp(mtime)
+    switch rotatePolicy {
+    case ROTATE_POLICY_HOUR:
+        start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+        return t.Format("Y-m-d-H"), start.Add(time.Hour).UnixNano()/1e6
+    case ROTATE_POLICY_DAY:
+        start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+        return t.Format("Y-m-d"), start.AddDate(0, 0, 1).UnixNano()/1e6
+    }
+    return "", 0
+}
+
+// 获取输出路径对应时间分段的写入对象
+func getSegmentWriter(base string, mtime int64) *segmentWriter {
+    period, periodEnd := getSegmentPeriod(mtime)
+    return segmentMap.GetOrSetFuncLock(base + "#" + period, func() interface{} {
+        return &segmentWriter {
+            base      : base,
+            period    : period,
+            periodEnd : periodEnd,
+        }
+    }).(*segmentWriter)
+}
+
+// 生成分段文件路径
+func (w *segmentWriter) buildPath(index int) string {
+    path := w.base
+    if w.period != "" {
+        path += "." + w.period
+    }
+    if index > 0 {
+        path += fmt.Sprintf(".%d", index)
+    }
+    return path + getCompressionExt()
+}
+
+// 确定当前分段文件路径，已写入完成的文件(存在完成标记)不再写入，使用下一个序号的文件
+func (w *segmentWriter) current() string {
+    if w.path == "" {
+        for w.path = w.buildPath(w.index); gfile.Exists(w.path + SEGMENT_DONE_EXT); w.path = w.buildPath(w.index) {
+            w.index++
+        }
+    }
+    return w.path
+}
+
+// 关闭当前分段文件并写入完成标记，之后的写入使用下一个序号的文件
+func (w *segmentWriter) complete() {
+    if w.path == "" {
+        return
+    }
+    handles.close(w.path)
+    if !gfile.Exists(w.path) {
+        return
+    }
+    if err := gfile.PutContents(w.path + SEGMENT_DONE_EXT, ""); err != nil {
+        glog.Error(w.path, err)
+        return
+    }
+    glog.Debugfln("segment completed: %s", w.path)
+    w.index++
+    w.path = ""
+}
+
+// 写入内容，写入失败时每隔1秒重试直到成功。分段已结束时返回false，需要重新获取写入对象。
+func (w *segmentWriter) write(content []byte) bool {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if w.retired {
+        return false
+    }
+    size := handles.write(w.current(), compressContent(content))
+    // 超过大小限制时切分到下一个文件
+    if rotateMaxBytes > 0 && size >= rotateMaxBytes {
+        w.complete()
+    }
+    return true
+}
+
+// 将日志记录按照时间分段写入输出文件，items需要按照时间升序排列
+func writeSegments(base string, items []*bufferItem) {
+    buffer := bytes.NewBuffer(nil)
+    period := ""
+    mtime  := int64(0)
+    flush  := func() {
+        for buffer.Len() > 0 && !getSegmentWriter(base, mtime).write(buffer.Bytes()) {
+        }
+        buffer.Reset()
+    }
+    for _, item := range items {
+        content := encodeRecord(item)
+        p, _    := getSegmentPeriod(item.mtime)
+        if p != period || (rotateMaxBytes > 0 && int64(buffer.Len() + len(content)) > rotateMaxBytes) {
+            flush()
+            period = p
+            mtime  = item.mtime
+        }
+        buffer.WriteString(content)
+    }
+    flush()
+}
+
+// 输出文件交给其他副本写入之前(横向扩展模式下ROUTE_TOPIC partition重新分配)，关闭该输出路径所有时间分段的文件句柄并移除写入对象。
+// 分段文件由新的副本继续写入，因此不写入完成标记，本副本之后也不会再完成或者写入这些分段。
+func releaseSegments(base string) {
+    for _, key := range segmentMap.Keys() {
+        if !strings.HasPrefix(key, base + "#") {
+            continue
+        }
+        v := segmentMap.Get(key)
+        if v == nil {
+            continue
+        }
+        w := v.(*segmentWriter)
+        w.mu.Lock()
+        if w.path != "" {
+            handles.close(w.path)
+        }
+        w.retired = true
+        segmentMap.Remove(key)
+        w.mu.Unlock()
+    }
+}
+
+// 检查时间分段是否结束，结束后关闭句柄并写入完成标记。
+// 分段结束时间之后还需要等待缓冲区时间及ROTATE_GRACE，以便接收延迟到达的日志记录。
+func checkSegmentCron() {
+    now := gtime.Millisecond()
+    for _, key := range segmentMap.Keys() {
+        v := segmentMap.Get(key)
+        if v == nil {
+            continue
+        }
+        w := v.(*segmentWriter)
+        w.mu.Lock()
+        if w.periodEnd > 0 && now > w.periodEnd + (bufferTime + rotateGrace)*1000 {
+            w.complete()
+            w.retired = true
+            segmentMap.Remove(key)
+        }
+        w.mu.Unlock()
+    }
+}
+
+// 启动时为上次运行遗留的已结束时间分段文件写入完成标记。
+// 分段状态只保存在内存中，进程退出时正在写入的旧分段不会再被写入，也不会再由checkSegmentCron完成。
+// 横向扩展模式下输出文件可能属于其他副本，不做处理(没有完成标记的分段超过EXPIRE天后由log-archiver归档)。
+func completeStaleSegments() {
+    if scaleMode == SCALE_MODE_ROUTE || (rotatePolicy != ROTATE_POLICY_HOUR && rotatePolicy != ROTATE_POLICY_DAY) {
+        return
+    }
+    paths, err := gfile.ScanDir(logPath, "*", true)
+    if err != nil {
+        glog.Error(err)
+        return
+    }
+    now := gtime.Millisecond()
+    for _, path := range paths {
+        // 不处理转储端自身的状态目录、完成标记及已归档的文件
+        if strings.Contains(path, "/__dumper_") || gfile.IsDir(path) || gfile.Exists(path + SEGMENT_DONE_EXT) {
+            continue
+        }
+        ext := gfile.Ext(path)
+        if ext == SEGMENT_DONE_EXT || ext == ".bz2" {
+            continue
+        }
+        periodEnd := getSegmentPeriodEnd(path)
+        if periodEnd == 0 || now <= periodEnd + (bufferTime + rotateGrace)*1000 {
+            continue
+        }
+        if err := gfile.PutContents(path + SEGMENT_DONE_EXT, ""); err != nil {
+            glog.Error(path, err)
+            continue
+        }
+        glog.Debugfln("stale segment completed: %s", path)
+    }
+}
+
+// 从分段文件名称中解析时间分段的结束时间(毫秒)，不是当前切分策略的分段文件时返回0
+func getSegmentPeriodEnd(path string) int64 {
+    pattern, layout := `\.(\d{4}-\d{2}-\d{2})(\.\d+)?(\.gz|\.zst)?$`, "2006-01-02"
+    if rotatePolicy == ROTATE_POLICY_HOUR {
+        pattern, layout = `\.(\d{4}-\d{2}-\d{2}-\d{2})(\.\d+)?(\.gz|\.zst)?$`, "2006-01-02-15"
+    }
+    match, _ := gregex.MatchString(pattern, path)
+    if len(match) < 2 {
+        return 0
+    }
+    start, err := time.ParseInLocation(layout, match[1], time.Local)
+    if err != nil {
+        return 0
+    }
+    if rotatePolicy == ROTATE_POLICY_HOUR {
+        return start.Add(time.Hour).UnixNano()/1e6
+    }
+    return start.AddDate(0, 0, 1).UnixNano()/1e6
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "github.com/Shopify/sarama"
+    "github.com/gogf/gf/g/container/gmap"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gkafka"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+const (
+    SCALE_MODE_NONE  = "none"  // 单副本运行
+    SCALE_MODE_ROUTE = "route" // 多副本运行，日志记录按照输出路径转发到ROUTE_TOPIC，每个输出文件只由一个副本写入
+)
+
+// 转发到ROUTE_TOPIC的日志记录，使用输出文件路径作为消息key，
+// 同一输出文件的记录进入同一个partition，由消费分组中唯一拥有该partition的副本写入
+type RoutedMessage struct {
+    Path      string   `json:"path"`      // 输出文件路径(相对于日志目录)
+    Topic     string   `json:"topic"`     // 源消息所在的topic
+    Partition int      `json:"partition"` // 源消息所在的partition
+    Offset    int      `json:"offset"`    // 源消息的offset
+    Message   *Message `json:"message"`   // 源消息中属于该输出文件的连续日志记录
+}
+
+// ROUTE_TOPIC消费分组的处理对象
+type routeHandler struct{}
+
+var (
+    // 转发日志记录的kafka生产者
+    routeProducer     sarama.SyncProducer
+    routeProducerOnce sync.Once
+    // ROUTE_TOPIC消费结束(已写入全部缓冲区并提交offset)
+    routeDone         = make(chan struct{})
+    // 当前副本写入的输出文件路径及其所属的ROUTE_TOPIC partition
+    routePathMap      = gmap.NewStringIntMap()
+)
+
+// 获取转发日志记录的kafka生产者，创建失败时每隔1秒重试
+func getRouteProducer() sarama.SyncProducer {
+    routeProducerOnce.Do(func() {
+        config := sarama.NewConfig()
+        config.Producer.Return.Successes = true
+        config.Producer.RequiredAcks     = sarama.WaitForAll
+        config.Producer.Partitioner      = sarama.NewHashPartitioner
+        if err := kafkaAuth.Apply(config); err != nil {
+            panic(err)
+        }
+        for {
+            if p, err := sarama.NewSyncProducer(strings.Split(kafkaAddr, ","), config); err != nil {
+                glog.Error(err)
+                time.Sleep(time.Second)
+            } else {
+                routeProducer = p
+                break
+            }
+        }
+    })
+    return routeProducer
+}
+
+// 将消息中的日志记录按照输出路径拆分为连续的记录段转发到ROUTE_TOPIC，全部发送成功后才提交源消息的offset
+func routeMessage(msg *Message, kafkaMsg *gkafka.Message, refs []*offsetRef) {
+    var routed *RoutedMessage
+    messages := make([]*sarama.ProducerMessage, 0)
+    size     := 0
+    start    := msg.Start
+    flush    := func() {
+        if routed == nil {
+            return
+        }
+        content, err := json.Marshal(routed)
+        if err != nil {
+            glog.Error(err)
+            return
+        }
+        messages = append(messages, &sarama.ProducerMessage {
+            Topic : routeTopic,
+            Key   : sarama.StringEncoder(routed.Path),
+            Value : sarama.ByteEncoder(content),
+        })
+    }
+    for i, content := range msg.Msgs {
+        path, _ := filepath.Rel(logPath, buildOutputPath(msg, kafkaMsg, getRecordTime(content)))
+        if routed == nil || routed.Path != path || size + len(content) > routeMaxBytes {
+            flush()
+            part      := *msg
+            part.Msgs  = make([]string, 0)
+            part.Ends  = nil
+            part.Start = start
+            routed     = &RoutedMessage {
+                Path      : path,
+                Topic     : kafkaMsg.Topic,
+                Partition : kafkaMsg.Partition,
+                Offset    : kafkaMsg.Offset,
+                Message   : &part,
+            }
+            size = 0
+        }
+        routed.Message.Msgs = append(routed.Message.Msgs, content)
+        if len(msg.Ends) == len(msg.Msgs) {
+            routed.Message.Ends = append(routed.Message.Ends, msg.Ends[i])
+            routed.Message.End  = msg.Ends[i]
+            start               = msg.Ends[i]
+        }
+        size += len(content)
+    }
+    flush()
+    // 发送失败时阻塞重试直到成功，重复发送的记录由写入的副本过滤
+    for len(messages) > 0 {
+        if err := getRouteProducer().SendMessages(messages); err != nil {
+            glog.Error(err)
+            time.Sleep(time.Second)
+            continue
+        }
+        break
+    }
+    doneOffsetRefs(refs)
+}
+
+// 处理ROUTE_TOPIC中的消息
+func handleRoutedMessage(consumerMsg *sarama.ConsumerMessage, ref *offsetRef) {
+    routed := &RoutedMessage{}
+    if err := json.Unmarshal(consumerMsg.Value, routed); err != nil || routed.Message == nil {
+        glog.Errorfln("invalid routed message at partition %d offset %d: %v", consumerMsg.Partition, consumerMsg.Offset, err)
+        ref.done()
+        return
+    }
+    msg      := routed.Message
+    kafkaMsg := &gkafka.Message {
+        Topic     : routed.Topic,
+        Partition : routed.Partition,
+        Offset    : routed.Offset,
+    }
+    // 字节范围窗口按照ROUTE_TOPIC partition保存，partition重新分配后新的副本可以继续过滤
+    ranges := dedupMessage(msg, kafkaMsg, getRouteDedupScope(consumerMsg.Partition))
+    path   := filepath.Join(logPath, routed.Path)
+    routePathMap.Set(path, int(consumerMsg.Partition))
+    addToBufferArray(msg, kafkaMsg, ranges, newCommitUnit([]*offsetRef{ref}, len(msg.Msgs)), path)
+}
+
+// 释放ROUTE_TOPIC partition对应的输出文件(包括延迟记录文件)，关闭文件句柄并移除分段写入对象，
+// partition重新分配给本副本时重新确定分段文件
+func releaseRoutePaths(partition int32) {
+    for _, path := range routePathMap.Keys() {
+        if routePathMap.Get(path) != int(partition) {
+            continue
+        }
+        releaseSegments(path)
+        releaseSegments(path + LATE_FILE_EXT)
+        routePathMap.Remove(path)
+    }
+}
+
+// 加载分配到的partition已写入的字节范围窗口(之前由其他副本保存)
+func (h *routeHandler) Setup(session sarama.ConsumerGroupSession) error {
+    glog.Debugfln("route partitions assigned, generation %d: %v", session.GenerationID(), session.Claims())
+    for _, partition := range session.Claims()[routeTopic] {
+        loadDedupWindows(getRouteDedupScope(partition))
+    }
+    return nil
+}
+
+// 分区被重新分配之前(副本加入或者离开)写入所有缓冲区中的日志记录，关闭输出文件，保存各partition的字节范围窗口，
+// 并在提交offset之后才交给其他副本，保证同一输出文件不会同时被两个副本写入；
+// 源消息未提交offset时重新转发的记录由新的副本根据保存的字节范围窗口过滤
+func (h *routeHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+    flushAllBuffers()
+    for _, partition := range session.Claims()[routeTopic] {
+        releaseRoutePaths(partition)
+        releaseDedupWindows(getRouteDedupScope(partition))
+    }
+    session.Commit()
+    glog.Debugfln("route partitions released, generation %d", session.GenerationID())
+    return nil
+}
+
+func (h *routeHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+    tracker := newPartitionTracker(func(offset int) {
+        // kafka中提交的是下一条需要读取的offset
+        session.MarkOffset(claim.Topic(), claim.Partition(), int64(offset) + 1, "")
+    })
+    for consumerMsg := range claim.Messages() {
+        handleRoutedMessage(consumerMsg, tracker.begin(int(consumerMsg.Offset)))
+    }
+    return nil
+}
+
+// 消费ROUTE_TOPIC，写入分配给当前副本的输出文件，出错时按照退避时间重试
+func runRouteConsumer(ctx context.Context) {
+    defer close(routeDone)
+    config := sarama.NewConfig()
+    config.Version                  = sarama.V1_0_0_0
+    config.Consumer.Return.Errors   = true
+    config.Consumer.Offsets.Initial = sarama.OffsetOldest
+    if err := kafkaAuth.Apply(config); err != nil {
+        panic(err)
+    }
+    failures := 0
+    var group sarama.ConsumerGroup
+    for group == nil && ctx.Err() == nil {
+        g, err := sarama.NewConsumerGroup(strings.Split(kafkaAddr, ","), KAFKA_GROUP_NAME_ROUTE, config)
+        if err != nil {
+            failures++
+            glog.Errorfln("cannot create route consumer group, retry in %v: %s", getBackoff(failures), err.Error())
+            time.Sleep(getBackoff(failures))
+            continue
+        }
+        group = g
+    }
+    if group == nil {
+        return
+    }
+    defer group.Close()
+    go func() {
+        for err := range group.Errors() {
+            glog.Error(err)
+        }
+    }()
+    failures = 0
+    for ctx.Err() == nil {
+        if err := group.Consume(ctx, []string{routeTopic}, &routeHandler{}); err != nil {
+            failures++
+            addConsumerRestart(routeTopic)
+            glog.Errorfln("route consumer failed, retry in %v: %s", getBackoff(failures), err.Error())
+            time.Sleep(getBackoff(failures))
+            continue
+        }
+        failures = 0
+    }
+}
+
+// 启动横向扩展模式，收到退出信号时停止消费源topic，写入全部缓冲区并提交offset之后退出，
+// 其他副本重新分配partition后继续处理
+func startRouting() {
+    ctx, cancel := context.WithCancel(context.Background())
+    go runRouteConsumer(ctx)
+    go func() {
+        signals := make(chan os.Signal, 1)
+        signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+        <-signals
+        glog.Info("stopping replica", replicaId)
+        for _, topic := range consumerMap.Keys() {
+            if c, ok := consumerMap.Get(topic).(*topicConsumer); ok {
+                c.shutdown()
+            }
+        }
+        cancel()
+        <-routeDone
+        dumpDedupWindows()
+        for _, topic := range topicMap.Keys() {
+            if offsetMap, ok := topicMap.Get(topic).(*gmap.StringIntMap); ok {
+                dumpOffsetMap(topic, offsetMap)
+            }
+        }
+        os.Exit(0)
+    }()
+}
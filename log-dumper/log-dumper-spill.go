@@ -0,0 +1,126 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// 缓冲记录内容写入的磁盘文件，一次写入的所有记录共用一个文件，文件中的记录全部写入输出文件后删除
+type spillFile struct {
+    mu   sync.Mutex
+    path string
+    refs int // 尚未写入输出文件的记录数量
+}
+
+// 缓冲记录内容在磁盘文件中的位置
+type spillRef struct {
+    file   *spillFile
+    offset int64
+    size   int
+}
+
+var (
+    // 缓冲记录磁盘文件序号
+    bufferSpillId int64
+)
+
+// 清理上次运行遗留的缓冲记录磁盘文件，这些文件已经无效(对应的消息会被重新消费)
+func cleanBufferSpillDir() {
+    if gfile.Exists(bufferSpillDir) {
+        if err := os.RemoveAll(bufferSpillDir); err != nil {
+            glog.Error(err)
+        }
+    }
+}
+
+// 将记录内容写入一个新的磁盘文件并释放内存中的内容，记录仍然保留在缓冲区中原来的位置，写入文件时再读取。
+// 返回释放的内存大小，写入磁盘失败时内容仍然保存在内存中。
+func spillItems(items []*bufferItem) int64 {
+    if len(items) == 0 {
+        return 0
+    }
+    buffer := bytes.NewBuffer(nil)
+    for _, item := range items {
+        buffer.WriteString(item.content)
+    }
+    file := &spillFile {
+        path : fmt.Sprintf("%s/%d.buffer", bufferSpillDir, atomic.AddInt64(&bufferSpillId, 1)),
+        refs : len(items),
+    }
+    if err := gfile.PutBinContents(file.path, buffer.Bytes()); err != nil {
+        glog.Error(err)
+        return 0
+    }
+    freed  := int64(0)
+    offset := int64(0)
+    for _, item := range items {
+        item.spill = &spillRef {
+            file   : file,
+            offset : offset,
+            size   : len(item.content),
+        }
+        offset      += int64(len(item.content))
+        freed       += int64(len(item.content))
+        item.content = ""
+    }
+    return freed
+}
+
+// 读取写入磁盘的记录内容，读取失败时每隔1秒重试直到成功
+func loadSpilledItems(items []*bufferItem) {
+    for _, item := range items {
+        if item.spill == nil || item.content != "" {
+            continue
+        }
+        for {
+            content, err := item.spill.read()
+            if err == nil {
+                item.content = content
+                break
+            }
+            glog.Error(item.spill.file.path, err)
+            time.Sleep(time.Second)
+        }
+    }
+}
+
+// 记录写入输出文件后释放磁盘文件中的内容，文件中的记录全部写入后删除文件
+func releaseSpilledItems(items []*bufferItem) {
+    for _, item := range items {
+        if item.spill != nil {
+            item.spill.file.release()
+        }
+    }
+}
+
+// 读取记录内容
+func (r *spillRef) read() (string, error) {
+    f, err := os.Open(r.file.path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    content := make([]byte, r.size)
+    if _, err := f.ReadAt(content, r.offset); err != nil {
+        return "", err
+    }
+    return string(content), nil
+}
+
+// 释放一条记录，没有未写入的记录时删除文件
+func (f *spillFile) release() {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.refs--; f.refs > 0 {
+        return
+    }
+    if err := os.Remove(f.path); err != nil {
+        glog.Error(f.path, err)
+    }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "github.com/gogf/gf/g/os/gfile"
+    "go.etcd.io/bbolt"
+    "time"
+)
+
+const (
+    OFFSET_BOLT_BUCKET = "offsets" // bbolt中保存offset的bucket名称，键名为topic
+)
+
+// bbolt存储，适合将offset保存到与日志目录不同的本地磁盘
+type boltOffsetStore struct {
+    db *bbolt.DB
+}
+
+func newBoltOffsetStore(path string) (*boltOffsetStore, error) {
+    if err := gfile.Mkdir(gfile.Dir(path)); err != nil {
+        return nil, err
+    }
+    // 数据库文件只允许一个进程打开，等待其他进程释放
+    db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout : 10*time.Second})
+    if err != nil {
+        return nil, err
+    }
+    err = db.Update(func(tx *bbolt.Tx) error {
+        _, err := tx.CreateBucketIfNotExists([]byte(OFFSET_BOLT_BUCKET))
+        return err
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &boltOffsetStore{db : db}, nil
+}
+
+func (s *boltOffsetStore) Load(topic string) (offsets map[int]int, err error) {
+    err = s.db.View(func(tx *bbolt.Tx) error {
+        if content := tx.Bucket([]byte(OFFSET_BOLT_BUCKET)).Get([]byte(topic)); content != nil {
+            offsets, err = decodeOffsetFile(content)
+            return err
+        }
+        offsets = make(map[int]int)
+        return nil
+    })
+    return
+}
+
+// 与已保存的offset合并后写入，在同一个事务中完成
+func (s *boltOffsetStore) Save(topic string, offsets map[int]int) error {
+    return s.db.Update(func(tx *bbolt.Tx) error {
+        bucket := tx.Bucket([]byte(OFFSET_BOLT_BUCKET))
+        merged := make(map[int]int)
+        if content := bucket.Get([]byte(topic)); content != nil {
+            if m, err := decodeOffsetFile(content); err == nil {
+                merged = m
+            }
+        }
+        for partition, offset := range offsets {
+            merged[partition] = offset
+        }
+        content, err := encodeOffsetFile(topic, merged)
+        if err != nil {
+            return err
+        }
+        return bucket.Put([]byte(topic), content)
+    })
+}
+
+func (s *boltOffsetStore) Topics() ([]string, error) {
+    topics := make([]string, 0)
+    err    := s.db.View(func(tx *bbolt.Tx) error {
+        return tx.Bucket([]byte(OFFSET_BOLT_BUCKET)).ForEach(func(k, v []byte) error {
+            topics = append(topics, string(k))
+            return nil
+        })
+    })
+    return topics, err
+}
+
+func (s *boltOffsetStore) Close() error {
+    return s.db.Close()
+}
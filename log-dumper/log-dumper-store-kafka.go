@@ -0,0 +1,143 @@
+package main
+
+import (
+    "fmt"
+    "github.com/Shopify/sarama"
+    "strings"
+    "sync"
+)
+
+// kafka存储，offset提交到单独的消费分组(与实际消费的分组区分，避免与消费端的提交冲突)，
+// kafka中提交的是下一条需要读取的offset，因此读写时需要转换
+type kafkaOffsetStore struct {
+    mu       sync.Mutex
+    client   sarama.Client
+    manager  sarama.OffsetManager
+    managers map[string]sarama.PartitionOffsetManager // 键名为buildOffsetKey生成的key
+    reset    bool                                     // 是否直接覆盖已提交的offset(迁移时使用，MarkOffset只会向前推进)
+}
+
+func newKafkaOffsetStore(group string) (*kafkaOffsetStore, error) {
+    config := sarama.NewConfig()
+    config.Consumer.Offsets.Initial           = sarama.OffsetNewest
+    config.Consumer.Offsets.AutoCommit.Enable = false
+    config.Consumer.Return.Errors             = true
+    if err := kafkaAuth.Apply(config); err != nil {
+        return nil, err
+    }
+    client, err := sarama.NewClient(strings.Split(kafkaAddr, ","), config)
+    if err != nil {
+        return nil, err
+    }
+    manager, err := sarama.NewOffsetManagerFromClient(group, client)
+    if err != nil {
+        client.Close()
+        return nil, err
+    }
+    return &kafkaOffsetStore {
+        client   : client,
+        manager  : manager,
+        managers : make(map[string]sarama.PartitionOffsetManager),
+    }, nil
+}
+
+// 获取partition的offset管理对象
+func (s *kafkaOffsetStore) partitionManager(topic string, partition int) (sarama.PartitionOffsetManager, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    key := buildOffsetKey(topic, partition)
+    if m, ok := s.managers[key]; ok {
+        return m, nil
+    }
+    m, err := s.manager.ManagePartition(topic, int32(partition))
+    if err != nil {
+        return nil, err
+    }
+    s.managers[key] = m
+    return m, nil
+}
+
+func (s *kafkaOffsetStore) Load(topic string) (map[int]int, error) {
+    partitions, err := s.client.Partitions(topic)
+    if err != nil {
+        return nil, err
+    }
+    offsets := make(map[int]int)
+    for _, partition := range partitions {
+        m, err := s.partitionManager(topic, int(partition))
+        if err != nil {
+            return nil, err
+        }
+        // 没有提交过时返回OffsetNewest(-1)
+        if next, _ := m.NextOffset(); next > 0 {
+            offsets[int(partition)] = int(next) - 1
+        }
+    }
+    return offsets, nil
+}
+
+func (s *kafkaOffsetStore) Save(topic string, offsets map[int]int) error {
+    for partition, offset := range offsets {
+        m, err := s.partitionManager(topic, partition)
+        if err != nil {
+            return err
+        }
+        if s.reset {
+            m.ResetOffset(int64(offset) + 1, "")
+        } else {
+            m.MarkOffset(int64(offset) + 1, "")
+        }
+    }
+    // Commit同步提交，提交失败时错误写入各partition的错误通道，未成功提交的offset在下一次Commit时重试
+    s.manager.Commit()
+    return s.commitError()
+}
+
+// 读取提交后各partition返回的错误，没有错误时返回nil
+func (s *kafkaOffsetStore) commitError() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var first *sarama.ConsumerError
+    count := 0
+    for _, m := range s.managers {
+        for drained := false; !drained; {
+            select {
+            case err := <-m.Errors():
+                if first == nil {
+                    first = err
+                }
+                count++
+            default:
+                drained = true
+            }
+        }
+    }
+    if first == nil {
+        return nil
+    }
+    return fmt.Errorf("commit offsets failed, %d errors, topic: %s, partition: %d, error: %v", count, first.Topic, first.Partition, first.Err)
+}
+
+func (s *kafkaOffsetStore) Topics() ([]string, error) {
+    topics, err := s.client.Topics()
+    if err != nil {
+        return nil, err
+    }
+    result := make([]string, 0)
+    for _, topic := range topics {
+        if offsets, err := s.Load(topic); err == nil && len(offsets) > 0 {
+            result = append(result, topic)
+        }
+    }
+    return result, nil
+}
+
+func (s *kafkaOffsetStore) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, m := range s.managers {
+        m.Close()
+    }
+    s.manager.Close()
+    return s.client.Close()
+}
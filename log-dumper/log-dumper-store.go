@@ -0,0 +1,149 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/gogf/gf/g/os/gfile"
+    "github.com/gogf/gf/g/os/glog"
+    "github.com/gogf/gf/g/os/gtime"
+    "github.com/gogf/gf/g/util/gconv"
+    "os"
+    "strings"
+)
+
+const (
+    OFFSET_STORE_FILE   = "file"  // offset保存到日志目录下的文件
+    OFFSET_STORE_KAFKA  = "kafka" // offset提交到kafka(使用单独的消费分组)
+    OFFSET_STORE_BOLT   = "bolt"  // offset保存到本地的bbolt数据库
+    OFFSET_FILE_VERSION = 1       // offset文件格式版本
+)
+
+// 已处理的kafka offset存储，offset为已处理的最后一条消息的offset(不是下一条)
+type OffsetStore interface {
+    // 读取topic已保存的offset，键名为partition，没有保存时返回空map
+    Load(topic string) (map[int]int, error)
+    // 保存topic的offset，只包含需要更新的partition
+    Save(topic string, offsets map[int]int) error
+    // 已保存offset的topic列表
+    Topics() ([]string, error)
+    Close() error
+}
+
+// topic offset文件内容，每个topic一个文件(bolt存储中为一个键值)
+type offsetFile struct {
+    Version    int         `json:"version"`    // 文件格式版本
+    Topic      string      `json:"topic"`
+    Partitions map[int]int `json:"partitions"` // 键名为partition，键值为已处理的offset
+    Updated    int64       `json:"updated"`    // (秒)保存时间
+}
+
+// 根据存储类型创建offset存储
+func newOffsetStore(kind string) (OffsetStore, error) {
+    switch kind {
+    case OFFSET_STORE_FILE:
+        dir := fmt.Sprintf("%s/%s", logPath, KAFKA_OFFSETS_DIR_NAME)
+        // 横向扩展模式下各副本共享日志目录，每个副本使用单独的目录，避免同时读写同一个offset文件相互覆盖
+        if scaleMode == SCALE_MODE_ROUTE {
+            dir = fmt.Sprintf("%s/%s", dir, replicaId)
+        }
+        return &fileOffsetStore{dir : dir}, nil
+    case OFFSET_STORE_KAFKA:
+        return newKafkaOffsetStore(offsetKafkaGroup)
+    case OFFSET_STORE_BOLT:
+        return newBoltOffsetStore(offsetBoltPath)
+    }
+    return nil, fmt.Errorf("unknown offset store: %s", kind)
+}
+
+// 编码topic offset内容
+func encodeOffsetFile(topic string, offsets map[int]int) ([]byte, error) {
+    return json.Marshal(&offsetFile {
+        Version    : OFFSET_FILE_VERSION,
+        Topic      : topic,
+        Partitions : offsets,
+        Updated    : gtime.Second(),
+    })
+}
+
+// 解码topic offset内容
+func decodeOffsetFile(content []byte) (map[int]int, error) {
+    file := &offsetFile{}
+    if err := json.Unmarshal(content, file); err != nil {
+        return nil, err
+    }
+    if file.Version != OFFSET_FILE_VERSION {
+        return nil, fmt.Errorf("unsupported offset file version: %d", file.Version)
+    }
+    if file.Partitions == nil {
+        file.Partitions = make(map[int]int)
+    }
+    return file.Partitions, nil
+}
+
+// 文件存储，每个topic一个文件: <dir>/<topic>.offsets.json，
+// 兼容旧版本的<topic>.<partition>.offset文件(新文件不存在时读取)
+type fileOffsetStore struct {
+    dir string
+}
+
+func (s *fileOffsetStore) path(topic string) string {
+    return fmt.Sprintf("%s/%s.offsets.json", s.dir, topic)
+}
+
+func (s *fileOffsetStore) Load(topic string) (map[int]int, error) {
+    path := s.path(topic)
+    if gfile.Exists(path) {
+        return decodeOffsetFile(gfile.GetBinContents(path))
+    }
+    offsets  := make(map[int]int)
+    files, _ := gfile.ScanDir(s.dir, "*.offset")
+    for _, file := range files {
+        if t, partition := parseOffsetKey(gfile.Name(file)); t == topic {
+            offsets[partition] = gconv.Int(strings.TrimSpace(gfile.GetContents(file)))
+        }
+    }
+    return offsets, nil
+}
+
+// 与已保存的offset合并后写入，先写临时文件再重命名，防止写入过程中崩溃导致文件损坏
+func (s *fileOffsetStore) Save(topic string, offsets map[int]int) error {
+    merged, err := s.Load(topic)
+    if err != nil {
+        glog.Error(err)
+        merged = make(map[int]int)
+    }
+    for partition, offset := range offsets {
+        merged[partition] = offset
+    }
+    content, err := encodeOffsetFile(topic, merged)
+    if err != nil {
+        return err
+    }
+    path := s.path(topic)
+    if err := gfile.PutBinContents(path + ".tmp", content); err != nil {
+        return err
+    }
+    return os.Rename(path + ".tmp", path)
+}
+
+func (s *fileOffsetStore) Topics() ([]string, error) {
+    topics := make([]string, 0)
+    exists := make(map[string]bool)
+    files, _ := gfile.ScanDir(s.dir, "*.offsets.json,*.offset")
+    for _, file := range files {
+        name  := gfile.Basename(file)
+        topic := strings.TrimSuffix(name, ".offsets.json")
+        if topic == name {
+            topic, _ = parseOffsetKey(gfile.Name(file))
+        }
+        if topic != "" && !exists[topic] {
+            exists[topic] = true
+            topics = append(topics, topic)
+        }
+    }
+    return topics, nil
+}
+
+func (s *fileOffsetStore) Close() error {
+    return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "fmt"
+    "github.com/gogf/gf/g/os/gfile"
+    "io/ioutil"
+    "os"
+    "reflect"
+    "sort"
+    "testing"
+)
+
+// 检查存储的读取、合并保存及topic列表
+func checkTestOffsetStore(t *testing.T, store OffsetStore) {
+    if offsets, err := store.Load("shop"); err != nil || len(offsets) != 0 {
+        t.Fatalf("empty store loaded %v, %v", offsets, err)
+    }
+    if err := store.Save("shop", map[int]int{0 : 10, 1 : 20}); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Save("shop", map[int]int{1 : 21, 2 : 30}); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Save("order", map[int]int{0 : 5}); err != nil {
+        t.Fatal(err)
+    }
+    expected := map[int]int{0 : 10, 1 : 21, 2 : 30}
+    if offsets, err := store.Load("shop"); err != nil || !reflect.DeepEqual(offsets, expected) {
+        t.Fatalf("loaded %v, %v, want %v", offsets, err, expected)
+    }
+    topics, err := store.Topics()
+    sort.Strings(topics)
+    if err != nil || !reflect.DeepEqual(topics, []string{"order", "shop"}) {
+        t.Fatalf("topics %v, %v, want [order shop]", topics, err)
+    }
+}
+
+// 创建临时目录，返回目录及清理函数
+func newTestOffsetDir(t *testing.T) (string, func()) {
+    dir, err := ioutil.TempDir("", "dumper-store")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return dir, func() {
+        os.RemoveAll(dir)
+    }
+}
+
+func TestFileOffsetStore(t *testing.T) {
+    dir, cleanup := newTestOffsetDir(t)
+    defer cleanup()
+    checkTestOffsetStore(t, &fileOffsetStore{dir : dir})
+}
+
+// 新文件不存在时读取旧版本的<topic>.<partition>.offset文件
+func TestFileOffsetStoreLegacy(t *testing.T) {
+    dir, cleanup := newTestOffsetDir(t)
+    defer cleanup()
+    store := &fileOffsetStore{dir : dir}
+    for partition, offset := range map[int]int{0 : 100, 3 : 300} {
+        gfile.PutContents(fmt.Sprintf("%s/legacy.%d.offset", dir, partition), fmt.Sprintf("%d\n", offset))
+    }
+    if topics, _ := store.Topics(); !reflect.DeepEqual(topics, []string{"legacy"}) {
+        t.Fatalf("topics %v, want [legacy]", topics)
+    }
+    if offsets, err := store.Load("legacy"); err != nil || !reflect.DeepEqual(offsets, map[int]int{0 : 100, 3 : 300}) {
+        t.Fatalf("loaded legacy offsets %v, %v", offsets, err)
+    }
+    // 保存时合并旧版本的offset，之后读取新文件
+    if err := store.Save("legacy", map[int]int{3 : 301}); err != nil {
+        t.Fatal(err)
+    }
+    offsets, err := decodeOffsetFile(gfile.GetBinContents(store.path("legacy")))
+    if err != nil || !reflect.DeepEqual(offsets, map[int]int{0 : 100, 3 : 301}) {
+        t.Fatalf("stored %v, %v, want map[0:100 3:301]", offsets, err)
+    }
+}
+
+func TestBoltOffsetStore(t *testing.T) {
+    dir, cleanup := newTestOffsetDir(t)
+    defer cleanup()
+    store, err := newBoltOffsetStore(dir + "/bolt/offsets.db")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    checkTestOffsetStore(t, store)
+}
+
+// 从文件存储迁移到bolt存储，迁移后bolt存储中的offset与文件存储相同
+func TestMigrateOffsets(t *testing.T) {
+    dir, cleanup := newTestOffsetDir(t)
+    defer cleanup()
+    defer func(path, boltPath, mode string) {
+        logPath        = path
+        offsetBoltPath = boltPath
+        scaleMode      = mode
+    }(logPath, offsetBoltPath, scaleMode)
+    logPath        = dir
+    offsetBoltPath = dir + "/offsets.db"
+    scaleMode      = SCALE_MODE_NONE
+    source, _     := newOffsetStore(OFFSET_STORE_FILE)
+    source.Save("shop", map[int]int{0 : 10, 1 : 20})
+    source.Save("order", map[int]int{0 : 5})
+    if err := migrateOffsets([]string{"-from", OFFSET_STORE_FILE, "-to", OFFSET_STORE_BOLT, "-topics", "shop"}); err != nil {
+        t.Fatal(err)
+    }
+    target, err := newBoltOffsetStore(offsetBoltPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer target.Close()
+    if offsets, err := target.Load("shop"); err != nil || !reflect.DeepEqual(offsets, map[int]int{0 : 10, 1 : 20}) {
+        t.Fatalf("migrated %v, %v, want map[0:10 1:20]", offsets, err)
+    }
+    // 只迁移指定的topic
+    if topics, _ := target.Topics(); !reflect.DeepEqual(topics, []string{"shop"}) {
+        t.Fatalf("migrated topics %v, want [shop]", topics)
+    }
+    if err := migrateOffsets([]string{"-from", OFFSET_STORE_BOLT, "-to", OFFSET_STORE_BOLT}); err == nil {
+        t.Fatal("migration to the same store accepted")
+    }
+}
@@ -13,12 +13,13 @@ package main
 import (
     "fmt"
     "github.com/gogf/gf/g/container/gmap"
-    "github.com/gogf/gf/g/os/gcache"
     "github.com/gogf/gf/g/os/gcron"
     "github.com/gogf/gf/g/os/genv"
     "github.com/gogf/gf/g/os/glog"
     "github.com/gogf/gf/g/util/gconv"
-    "time"
+    "github.com/gogf/gkafka"
+    "k8s-log/internal/kafkaauth"
+    "os"
 )
 
 const (
@@ -27,10 +28,47 @@ const (
     HANDLER_NUM_PER_TOPIC       = "5"                          // 同一个topic消费处理时，允许并发的goroutine数量
     AUTO_SAVE_INTERVAL          = "5"                          // (秒)日志内容批量保存间隔
     KAFKA_OFFSETS_DIR_NAME      = "__dumper_offsets"           // 用于保存应用端offsets的目录名称
+    AUDIT_DIR_NAME              = "__dumper_audit"             // 用于保存消息序列号审计日志的目录名称
+    AUDIT_STREAM_TTL            = "86400"                      // (秒)日志文件序列号状态的保留时间，超过该时间没有新消息时清除
+    AUDIT_MAX_GAPS              = "1000"                       // 每个日志文件最多记录的未到达序列号数量(用于区分乱序及重复)
+    DEDUP_MAX_RANGES            = "128"                        // 每个源文件保留的已处理字节范围数量(不连续的范围)
+    DEDUP_MAX_STREAMS           = "100000"                     // 最多保留字节范围的源文件数量
+    DEDUP_TTL                   = "86400"                      // (秒)源文件字节范围的保留时间，超过该时间没有新消息时清除
+    OUTPUT_PATH_TEMPLATE        = "{app}/{path}"               // 默认值，输出文件路径模板(相对于日志目录)，默认与原始日志目录结构相同
+    OUTPUT_FORMAT               = "raw"                        // 默认值，输出格式: raw(原始内容), prefix(添加[主机/pod]前缀), json(JSON行，包含来源信息)
+    OUTPUT_COMPRESSION          = "none"                       // 默认值，输出文件压缩方式: none, gzip, zstd(每批写入为独立的压缩块)
+    ROTATE_POLICY               = "none"                       // 默认值，输出文件按照日志记录时间切分: none, hour, day
+    ROTATE_MAX_BYTES            = "0"                          // 默认值，(MB)输出文件大小限制，超过时切分到下一个文件，0表示不限制
+    ROTATE_GRACE                = "300"                        // 默认值，(秒)时间分段结束后(加上缓冲区时间)等待延迟日志的时间
+    HANDLE_CACHE_SIZE           = "1024"                       // 默认值，同时打开的输出文件句柄数量，超过时关闭最久未使用的句柄
+    HANDLE_IDLE_TIMEOUT         = "300"                        // 默认值，(秒)输出文件句柄空闲超过该时间后关闭
+    WRITE_BUFFER_SIZE           = "65536"                      // 默认值，(字节)输出文件写缓冲区大小
+    FSYNC_POLICY                = "none"                       // 默认值，输出文件同步到磁盘的策略: none, flush(每次批量写入后), interval(定时)
+    FSYNC_INTERVAL              = "5"                          // 默认值，(秒)定时同步间隔，同时也是空闲句柄的检查间隔
+    DEAD_LETTER_DIR_NAME        = "__dumper_deadletters"       // 用于保存死信记录的目录名称
+    PACKAGE_TIMEOUT             = "60"                         // 默认值，(秒)分包消息等待组装的最长时间，超时后写入死信
+    REASSEMBLY_MAX_MEMORY       = "256"                        // 默认值，(MB)等待组装的分包占用的内存上限，超过时分包写入磁盘
+    REASSEMBLY_SPILL_DIR        = "/tmp/log-dumper-spill"      // 默认值，等待组装的分包写入磁盘的目录(启动时清空)
+    BUFFER_SPILL_DIR            = "/tmp/log-dumper-buffer"     // 默认值，内存预算不足时缓冲记录的内容写入磁盘的目录(启动时清空)
+    OFFSET_STORE                = "file"                       // 默认值，已处理offset的存储方式: file(日志目录下的文件), kafka(提交到OFFSET_KAFKA_GROUP), bolt(本地bbolt数据库)
+    OFFSET_KAFKA_GROUP          = "group_log_dumper_offsets"   // 默认值，kafka存储使用的消费分组名称(不用于实际消费)
+    OFFSET_BOLT_PATH            = "/var/lib/log-dumper.db"     // 默认值，bolt存储的数据库文件路径
+    TOPIC_INCLUDE               = ""                           // 默认值，需要消费的topic正则，为空时消费所有topic
+    TOPIC_EXCLUDE               = "^__"                        // 默认值，不消费的topic正则(默认排除kafka内部topic)，为空时不排除
+    CONSUMER_BACKOFF_MIN        = "1"                          // 默认值，(秒)消费端重新连接的初始退避时间
+    CONSUMER_BACKOFF_MAX        = "60"                         // 默认值，(秒)消费端重新连接的最大退避时间
+    SCALE_MODE                  = "none"                       // 默认值，运行模式: none(单副本), route(多副本，日志记录按照输出路径转发到ROUTE_TOPIC，每个输出文件只由一个副本写入)
+    ROUTE_TOPIC                 = "__dumper_routed"            // 默认值，横向扩展模式下转发日志记录的topic
+    ROUTE_MAX_BYTES             = "524288"                     // 默认值，(字节)单条转发消息中日志内容的大小限制
+    HEALTH_STALL_TIMEOUT        = "300"                        // 默认值，(秒)消费端没有正常运行或者输出文件写入未完成超过该时间时/healthz返回失败
+    METRICS_ADDR                = ":9102"                      // 默认值，监控指标(/metrics)监听地址，为空时不开启
     KAFKA_GROUP_NAME            = "group_log_dumper"           // kafka消费端分组名称
     KAFKA_GROUP_NAME_DRYRUN     = "group_log_dumper_dryrun"    // kafka消费端分组名称(dryrun)
-    MAX_BUFFER_TIME_PERFILE     = "60"                         // (秒)缓冲区缓存日志的长度(按照时间衡量)
+    KAFKA_GROUP_NAME_ROUTE      = "group_log_dumper_route"     // 横向扩展模式下ROUTE_TOPIC的消费端分组名称
+    MAX_BUFFER_TIME_PERFILE     = "60"                         // (秒)缓冲区缓存日志的长度(按照日志时间衡量)，超过该时间没有新日志时写入全部缓存
+    LATE_POLICY                 = "inplace"                    // 默认值，延迟记录(日志时间早于已写入的水位线)的处理方式: inplace(直接写入), file(写入.late文件), drop(丢弃)
     MAX_BUFFER_LENGTH_PERFILE   = "100000"                     // 缓存区日志的容量限制，当达到容量时阻塞等待日志写入后再往缓冲区添加日志
+    BUFFER_MAX_MEMORY           = "1024"                       // 默认值，(MB)所有缓冲区共用的内存预算，超过时阻塞等待并将缓冲区中的日志内容写入磁盘
     DRYRUN                      = "false"                      // 测试运行，不真实写入文件
     DEBUG                       = "true"                       // 默认值，是否打开调试信息
 
@@ -46,10 +84,19 @@ type Package struct {
 
 // kafka消息数据结构
 type Message struct {
-    Path string   `json:"path"` // 日志文件路径
-    Msgs []string `json:"msgs"` // 日志内容(多条)
-    Time string   `json:"time"` // 发送时间(客户端搜集时间)
-    Host string   `json:"host"` // 节点主机名称
+    Path      string   `json:"path"`                // 日志文件路径
+    Msgs      []string `json:"msgs"`                // 日志内容(多条)
+    Time      string   `json:"time"`                // 发送时间(客户端搜集时间)
+    Host      string   `json:"host"`                // 节点主机名称
+    Namespace string   `json:"namespace,omitempty"` // pod所在的namespace(旧版本客户端为空)
+    Pod       string   `json:"pod,omitempty"`       // pod名称
+    Container string   `json:"container,omitempty"` // 日志卷名称
+    Epoch     int64    `json:"epoch"`               // 文件标识，旧版本客户端为0(不进行序列号检测)
+    Seq       int64    `json:"seq"`                 // 消息在文件中的序列号(同一文件标识下单调递增)
+    Start     int64    `json:"start"`               // 消息内容在文件中的起始位置
+    End       int64    `json:"end"`                 // 消息内容在文件中的结束位置(不包含)，即[start, end)
+    Ends      []int64  `json:"ends"`                // 每条日志记录在文件中的结束位置，用于过滤重发的日志记录
+    Rotated   bool     `json:"rotated,omitempty"`   // 内容是否来自轮转压缩文件，压缩文件的文件标识及序列号独立于日志文件
 }
 
 var (
@@ -62,37 +109,113 @@ var (
     saveInterval   = gconv.Int(genv.Get("SAVE_INTERVAL", AUTO_SAVE_INTERVAL))
     bufferTime     = gconv.Int64(genv.Get("MAX_BUFFER_TIME_PERFILE", MAX_BUFFER_TIME_PERFILE))
     bufferLength   = gconv.Int(genv.Get("MAX_BUFFER_LENGTH_PERFILE", MAX_BUFFER_LENGTH_PERFILE))
+    bufferMaxMemory = gconv.Int64(genv.Get("BUFFER_MAX_MEMORY", BUFFER_MAX_MEMORY))*1024*1024
+    latePolicy     = genv.Get("LATE_POLICY", LATE_POLICY)
     kafkaAddr      = genv.Get("KAFKA_ADDR")
-    kafkaClient    = newKafkaClient()
-    pkgCache       = gcache.New()
+    auditStreamTtl = gconv.Int64(genv.Get("AUDIT_STREAM_TTL", AUDIT_STREAM_TTL))
+    auditMaxGaps   = gconv.Int(genv.Get("AUDIT_MAX_GAPS", AUDIT_MAX_GAPS))
+    dedupMaxRanges  = gconv.Int(genv.Get("DEDUP_MAX_RANGES", DEDUP_MAX_RANGES))
+    dedupMaxStreams = gconv.Int(genv.Get("DEDUP_MAX_STREAMS", DEDUP_MAX_STREAMS))
+    dedupTtl        = gconv.Int64(genv.Get("DEDUP_TTL", DEDUP_TTL))
+    metricsAddr    = genv.Get("METRICS_ADDR", METRICS_ADDR)
+    healthStallTimeout = gconv.Int64(genv.Get("HEALTH_STALL_TIMEOUT", HEALTH_STALL_TIMEOUT))
+    packageTimeout  = gconv.Int64(genv.Get("PACKAGE_TIMEOUT", PACKAGE_TIMEOUT))
+    deadLetterTopic = genv.Get("DEAD_LETTER_TOPIC")
+    reassemblyMaxMemory = gconv.Int64(genv.Get("REASSEMBLY_MAX_MEMORY", REASSEMBLY_MAX_MEMORY))*1024*1024
+    reassemblySpillDir  = genv.Get("REASSEMBLY_SPILL_DIR", REASSEMBLY_SPILL_DIR)
+    bufferSpillDir      = genv.Get("BUFFER_SPILL_DIR", BUFFER_SPILL_DIR)
+    offsetStoreType  = genv.Get("OFFSET_STORE", OFFSET_STORE)
+    topicIncludeRegex  = compileTopicRegex(genv.Get("TOPIC_INCLUDE", TOPIC_INCLUDE))
+    topicExcludeRegex  = compileTopicRegex(genv.Get("TOPIC_EXCLUDE", TOPIC_EXCLUDE))
+    consumerBackoffMin = gconv.Int64(genv.Get("CONSUMER_BACKOFF_MIN", CONSUMER_BACKOFF_MIN))
+    consumerBackoffMax = gconv.Int64(genv.Get("CONSUMER_BACKOFF_MAX", CONSUMER_BACKOFF_MAX))
+    scaleMode     = genv.Get("SCALE_MODE", SCALE_MODE)
+    routeTopic    = genv.Get("ROUTE_TOPIC", ROUTE_TOPIC)
+    routeMaxBytes = gconv.Int(genv.Get("ROUTE_MAX_BYTES", ROUTE_MAX_BYTES))
+    // 副本名称，默认为主机名称(pod名称)
+    replicaId     = genv.Get("REPLICA_ID", genv.Get("HOSTNAME", "default"))
+    offsetKafkaGroup = genv.Get("OFFSET_KAFKA_GROUP", OFFSET_KAFKA_GROUP)
+    offsetBoltPath   = genv.Get("OFFSET_BOLT_PATH", OFFSET_BOLT_PATH)
+    outputPathTemplate = genv.Get("OUTPUT_PATH_TEMPLATE", OUTPUT_PATH_TEMPLATE)
+    outputFormat   = genv.Get("OUTPUT_FORMAT", OUTPUT_FORMAT)
+    outputCompression = genv.Get("OUTPUT_COMPRESSION", OUTPUT_COMPRESSION)
+    rotatePolicy   = genv.Get("ROTATE_POLICY", ROTATE_POLICY)
+    rotateMaxBytes = gconv.Int64(genv.Get("ROTATE_MAX_BYTES", ROTATE_MAX_BYTES))*1024*1024
+    rotateGrace    = gconv.Int64(genv.Get("ROTATE_GRACE", ROTATE_GRACE))
+    handleCacheSize   = gconv.Int(genv.Get("HANDLE_CACHE_SIZE", HANDLE_CACHE_SIZE))
+    handleIdleTimeout = gconv.Int64(genv.Get("HANDLE_IDLE_TIMEOUT", HANDLE_IDLE_TIMEOUT))
+    writeBufferSize   = gconv.Int(genv.Get("WRITE_BUFFER_SIZE", WRITE_BUFFER_SIZE))
+    fsyncPolicy       = genv.Get("FSYNC_POLICY", FSYNC_POLICY)
+    fsyncInterval     = gconv.Int(genv.Get("FSYNC_INTERVAL", FSYNC_INTERVAL))
+    // kafka安全设置，SASL用户名及密码通过KAFKA_SASL_USER(_FILE)及KAFKA_SASL_PASSWORD(_FILE)读取
+    kafkaAuth         = kafkaauth.FromEnv()
+    // 获取topic列表的kafka客户端，在main中创建
+    kafkaClient       *gkafka.Client
 )
 
 func main() {
     // 是否显示调试信息
     glog.SetDebug(debug)
 
+    // 在不同的offset存储之间迁移: log-dumper migrate-offsets -from file -to bolt
+    if len(os.Args) > 1 && os.Args[1] == "migrate-offsets" {
+        if err := migrateOffsets(os.Args[2:]); err != nil {
+            glog.Error(err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    // 已处理offset的存储
+    if store, err := newOffsetStore(offsetStoreType); err != nil {
+        panic(err)
+    } else {
+        offsetStore = store
+    }
+
+    // 清理上次运行遗留的分包及缓冲记录磁盘文件
+    cleanReassemblySpillDir()
+    cleanBufferSpillDir()
+
+    // 上次运行遗留的已结束时间分段写入完成标记
+    completeStaleSegments()
+
+    // 加载已写入的字节范围，用于过滤重复的日志记录
+    initDedupWindows()
+
     // 定时批量写日志到文件
     gcron.Add(fmt.Sprintf(`*/%d * * * * *`, saveInterval), handlerSavingContent)
 
+    // 定时同步输出文件并关闭空闲的文件句柄
+    gcron.Add(fmt.Sprintf(`*/%d * * * * *`, fsyncInterval), checkHandleCron)
+
+    // 定时检查输出文件的时间分段，关闭已结束的分段并写入完成标记
+    gcron.Add("*/10 * * * * *", checkSegmentCron)
+
     // 定时导出已处理的offset map
     gcron.DelayAdd(10, "* * * * * *", handlerDumpOffsetMapCron)
 
-    for {
-       if topics, err := kafkaClient.Topics(); err == nil {
-          for _, topic := range topics {
-              if !topicMap.Contains(topic) {
-                  //glog.Debugfln("add new topic handle: %s", topic)
-                  topicMap.Set(topic, gmap.NewStringIntMap())
-                  go handlerKafkaTopic(topic)
-              } else {
-                  //glog.Debug("no match topic:", topic)
-              }
-          }
-       } else {
-          glog.Error(err)
-          break
-       }
-       time.Sleep(TOPIC_AUTO_CHECK_INTERVAL*time.Second)
+    // 定时清理长时间没有新消息的日志文件序列号状态
+    gcron.Add("0 * * * * *", cleanAuditStreamCron)
+    gcron.Add("30 * * * * *", cleanDedupWindowCron)
+
+    // 定时检查超时未组装完成的分包消息
+    gcron.Add("*/10 * * * * *", checkPendingPackageCron)
+
+    // 监控指标
+    gcron.Add("*/15 * * * * *", updateConsumerLagCron)
+    startMetricsServer()
+
+    // 横向扩展模式
+    switch scaleMode {
+    case SCALE_MODE_NONE:
+    case SCALE_MODE_ROUTE:
+        startRouting()
+    default:
+        panic("unknown SCALE_MODE: " + scaleMode)
     }
-}
 
+    // 消费端管理
+    kafkaClient = newKafkaClient()
+    runConsumerManager()
+}